@@ -3,12 +3,17 @@ module github.com/tomwganem/ambassador-auth-jwt
 go 1.14
 
 require (
+	github.com/alicebob/miniredis/v2 v2.14.3
 	github.com/certifi/gocertifi v0.0.0-20190105021004-abcd57078448 // indirect
 	github.com/getsentry/raven-go v0.2.0
-	github.com/pkg/errors v0.8.1 // indirect
-	github.com/sirupsen/logrus v1.3.0
-	github.com/stretchr/testify v1.3.0 // indirect
-	golang.org/x/crypto v0.0.0-20190211182817-74369b46fc67 // indirect
-	golang.org/x/sys v0.0.0-20190213121743-983097b1a8a3 // indirect
+	github.com/go-redis/redis/v8 v8.11.4
+	github.com/prometheus/client_golang v1.10.0
+	github.com/sirupsen/logrus v1.6.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	go.opentelemetry.io/proto/otlp v0.9.0
+	google.golang.org/protobuf v1.27.1
 	gopkg.in/square/go-jose.v2 v2.2.2
 )
@@ -1,16 +1,26 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
-	"encoding/json"
 
 	raven "github.com/getsentry/raven-go"
 	log "github.com/sirupsen/logrus"
 	"github.com/tomwganem/ambassador-auth-jwt/pkg/httpserver"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/introspection"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/replay"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/revocation"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/token"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/tracing"
 )
 
 var (
@@ -20,6 +30,8 @@ var (
 	ListenPortStr string
 	// ListenPort saves LISTEN_PORT as an integer
 	ListenPort int
+	// AdminPort saves ADMIN_PORT as an integer. The /metrics endpoint is served on this port
+	AdminPort int
 	// JwtIssuer is set by the JWT_ISSUER env variable. It saves the url where the JWKeyset is found
 	JwtIssuer map[string]string
 	// JwtOutboundHeader defaults to X-JWT-PAYLOAD and is returned in the response
@@ -34,6 +46,20 @@ var (
 	AllowBasicAuthPathRegex string
 	// NewErrorMessageRegex specifies the paths that we return the new error structure for (needed for backwards compatibility)
 	NewErrorMessageRegex string
+	// Cors is set by the CORS env variable. It replaces the default CORS settings used by routes without their own
+	Cors *httpserver.CORS
+	// TokenSources is set by the TOKEN_SOURCES env variable. It replaces the default places tokens are read from
+	TokenSources []httpserver.TokenSource
+	// JwksRefreshInterval is set by the JWKS_REFRESH_INTERVAL env variable. Keysets are fetched again in the background at this interval
+	JwksRefreshInterval time.Duration
+	// JwksMaxAge is set by the JWKS_MAX_AGE env variable. The service is not ready when a keyset is older than this
+	JwksMaxAge time.Duration
+	// ShutdownTimeout is set by the SHUTDOWN_TIMEOUT env variable. It is how long in-flight requests are given to complete on SIGTERM
+	ShutdownTimeout time.Duration
+	// RevocationFile is set by the REVOCATION_FILE env variable. It is a json list of revoked tokens, loaded again when it changes
+	RevocationFile string
+	// Routes is set by the ROUTES env variable. It saves per path settings such as required scopes
+	Routes map[string]httpserver.Route
 )
 
 func init() {
@@ -60,11 +86,6 @@ func init() {
 	raven.SetRelease(Version)
 	log.SetFormatter(&log.JSONFormatter{TimestampFormat: time.RFC3339Nano})
 	log.SetOutput(os.Stdout)
-	log.WithFields(log.Fields{
-		"version":            Version,
-		"sentry_dsn":         os.Getenv("SENTRY_DSN"),
-		"sentry_environment": os.Getenv("SENTRY_CURRENT_ENV"),
-	}).Info("Starting ambassador-auth-jwt")
 	ListenPortStr = os.Getenv("LISTEN_PORT")
 	var err error
 	ListenPort, err = strconv.Atoi(ListenPortStr)
@@ -72,12 +93,110 @@ func init() {
 		log.Warn("Unable to convert LISTEN_PORT to integer, defaulting to port 3000")
 		ListenPort = 3000
 	}
+	AdminPort, err = strconv.Atoi(os.Getenv("ADMIN_PORT"))
+	if err != nil {
+		log.Warn("Unable to convert ADMIN_PORT to integer, defaulting to port 9090")
+		AdminPort = 9090
+	}
 
 	err = json.Unmarshal([]byte(os.Getenv("JWT_ISSUER")), &JwtIssuer)
 	if err != nil {
 		log.Fatal("Could not parse JWT_ISSUER ")
 	}
 
+	if routes := os.Getenv("ROUTES"); routes != "" {
+		err = json.Unmarshal([]byte(routes), &Routes)
+		if err != nil {
+			log.WithField("err", err).Fatal("Could not parse ROUTES")
+		}
+	}
+
+	if cors := os.Getenv("CORS"); cors != "" {
+		err = json.Unmarshal([]byte(cors), &Cors)
+		if err != nil {
+			log.WithField("err", err).Fatal("Could not parse CORS")
+		}
+	}
+
+	if tokenSources := os.Getenv("TOKEN_SOURCES"); tokenSources != "" {
+		err = json.Unmarshal([]byte(tokenSources), &TokenSources)
+		if err != nil {
+			log.WithField("err", err).Fatal("Could not parse TOKEN_SOURCES")
+		}
+	}
+
+	token.DefaultTimeout = durationEnv("JWKS_TIMEOUT", token.DefaultTimeout)
+	if jwksClients := os.Getenv("JWKS_CLIENTS"); jwksClients != "" {
+		err = json.Unmarshal([]byte(jwksClients), &token.Clients)
+		if err != nil {
+			log.WithField("err", err).Fatal("Could not parse JWKS_CLIENTS")
+		}
+	}
+	if keyFiles := os.Getenv("DECRYPTION_KEY_FILES"); keyFiles != "" {
+		token.DecryptionKeys, err = token.LoadDecryptionKeys(strings.Split(keyFiles, ","))
+		if err != nil {
+			log.WithField("err", err).Fatal("Could not load DECRYPTION_KEY_FILES")
+		}
+	}
+	if cacheSize := os.Getenv("VERIFICATION_CACHE_SIZE"); cacheSize != "" || os.Getenv("VERIFICATION_CACHE_TTL") != "" {
+		size := 10000
+		if cacheSize != "" {
+			size, err = strconv.Atoi(cacheSize)
+			if err != nil {
+				log.Warn("Unable to convert VERIFICATION_CACHE_SIZE to integer, defaulting to 10000")
+				size = 10000
+			}
+		}
+		token.Results = token.NewResultCache(size, durationEnv("VERIFICATION_CACHE_TTL", 5*time.Minute))
+	}
+	token.MinRefreshInterval = durationEnv("JWKS_MIN_REFRESH_INTERVAL", token.MinRefreshInterval)
+	token.CacheDir = os.Getenv("JWKS_CACHE_DIR")
+	token.CacheMaxAge = durationEnv("JWKS_CACHE_MAX_AGE", token.CacheMaxAge)
+	if maxSize := os.Getenv("JWKS_MAX_SIZE"); maxSize != "" {
+		token.MaxKeySetSize, err = strconv.ParseInt(maxSize, 10, 64)
+		if err != nil {
+			log.Warn("Unable to convert JWKS_MAX_SIZE to integer, defaulting to 1048576")
+			token.MaxKeySetSize = 1 << 20
+		}
+	}
+	if minRSABits := os.Getenv("JWKS_MIN_RSA_BITS"); minRSABits != "" {
+		token.MinRSAKeySize, err = strconv.Atoi(minRSABits)
+		if err != nil {
+			log.Warn("Unable to convert JWKS_MIN_RSA_BITS to integer, defaulting to 2048")
+			token.MinRSAKeySize = 2048
+		}
+	}
+
+	JwksRefreshInterval = durationEnv("JWKS_REFRESH_INTERVAL", httpserver.JwksRefreshInterval)
+	JwksMaxAge = durationEnv("JWKS_MAX_AGE", httpserver.JwksMaxAge)
+	ShutdownTimeout = durationEnv("SHUTDOWN_TIMEOUT", 30*time.Second)
+	httpserver.ReadTimeout = durationEnv("READ_TIMEOUT", httpserver.ReadTimeout)
+	httpserver.ReadHeaderTimeout = durationEnv("READ_HEADER_TIMEOUT", httpserver.ReadHeaderTimeout)
+	httpserver.WriteTimeout = durationEnv("WRITE_TIMEOUT", httpserver.WriteTimeout)
+	httpserver.IdleTimeout = durationEnv("IDLE_TIMEOUT", httpserver.IdleTimeout)
+	httpserver.TLSCertFile = os.Getenv("TLS_CERT_FILE")
+	httpserver.TLSKeyFile = os.Getenv("TLS_KEY_FILE")
+	httpserver.TLSClientCAFile = os.Getenv("TLS_CLIENT_CA_FILE")
+	if minVersion := os.Getenv("TLS_MIN_VERSION"); minVersion != "" {
+		httpserver.TLSMinVersion, err = httpserver.ParseTLSVersion(minVersion)
+		if err != nil {
+			log.WithField("err", err).Fatal("Could not parse TLS_MIN_VERSION")
+		}
+	}
+	if cipherSuites := os.Getenv("TLS_CIPHER_SUITES"); cipherSuites != "" {
+		httpserver.TLSCipherSuites, err = httpserver.ParseCipherSuites(cipherSuites)
+		if err != nil {
+			log.WithField("err", err).Fatal("Could not parse TLS_CIPHER_SUITES")
+		}
+	}
+	if maxHeaderBytes := os.Getenv("MAX_HEADER_BYTES"); maxHeaderBytes != "" {
+		httpserver.MaxHeaderBytes, err = strconv.Atoi(maxHeaderBytes)
+		if err != nil {
+			log.Warn("Unable to convert MAX_HEADER_BYTES to integer, defaulting to 1048576")
+			httpserver.MaxHeaderBytes = 1 << 20
+		}
+	}
+
 	//JwtIssuer = tempJwtIssuer.(map[string]string)
 	JwtOutboundHeader = os.Getenv("JWT_OUTBOUND_HEADER")
 	AllowBasicAuthHeaders := os.Getenv("ALLOW_BASIC_AUTH_HEADERS")
@@ -109,6 +228,55 @@ func init() {
 
 	httpserver.JwtIssuer = JwtIssuer
 	httpserver.JwtCheckExp = CheckExp
+	httpserver.AdminToken = os.Getenv("ADMIN_TOKEN")
+	httpserver.ExplainSecret = os.Getenv("EXPLAIN_SECRET")
+	if explainAll := os.Getenv("EXPLAIN_ALL"); explainAll != "" {
+		b, err := strconv.ParseBool(explainAll)
+		if err != nil {
+			log.Warn("Unable to convert EXPLAIN_ALL to bool: setting to false")
+			b = false
+		}
+		if env := os.Getenv("SENTRY_CURRENT_ENV"); b && (env == "production" || env == "prod") {
+			log.Warn("EXPLAIN_ALL is ignored when SENTRY_CURRENT_ENV is " + env)
+			b = false
+		}
+		httpserver.ExplainAll = b
+	}
+	revocation.DefaultTTL = durationEnv("REVOCATION_TTL", revocation.DefaultTTL)
+	introspection.Timeout = durationEnv("INTROSPECTION_TIMEOUT", introspection.Timeout)
+	httpserver.JwksRefreshInterval = JwksRefreshInterval
+	RevocationFile = os.Getenv("REVOCATION_FILE")
+	if RevocationFile != "" {
+		if err := httpserver.Revocations.LoadFile(RevocationFile); err != nil {
+			log.WithField("err", err).Fatal("Could not load REVOCATION_FILE")
+		}
+	}
+	httpserver.ReplayTTL = durationEnv("REPLAY_TTL", httpserver.ReplayTTL)
+	if replayStoreURL := os.Getenv("REPLAY_STORE_URL"); replayStoreURL != "" {
+		httpserver.ReplayStore, err = replay.NewRedisStore(replayStoreURL, "ambassador-auth-jwt:jti:")
+		if err != nil {
+			log.WithField("err", err).Fatal("Could not parse REPLAY_STORE_URL")
+		}
+	} else if replayCacheSize := os.Getenv("REPLAY_CACHE_SIZE"); replayCacheSize != "" {
+		size, err := strconv.Atoi(replayCacheSize)
+		if err != nil {
+			log.Warn("Unable to convert REPLAY_CACHE_SIZE to integer, defaulting to 100000")
+			size = 100000
+		}
+		httpserver.ReplayStore = replay.NewMemoryStore(size)
+	}
+	httpserver.IssuerRetryMin = durationEnv("ISSUER_RETRY_MIN", httpserver.IssuerRetryMin)
+	httpserver.IssuerRetryMax = durationEnv("ISSUER_RETRY_MAX", httpserver.IssuerRetryMax)
+	httpserver.JwksMaxAge = JwksMaxAge
+	if Routes != nil {
+		httpserver.Routes = Routes
+	}
+	if Cors != nil {
+		httpserver.DefaultCORS = *Cors
+	}
+	if len(TokenSources) > 0 {
+		httpserver.DefaultTokenSources = TokenSources
+	}
 	httpserver.AllowBasicAuthPassThrough = AllowBasicAuthPassThrough
 	if AllowBasicAuthHeaders != "" {
 		httpserver.AllowBasicAuthHeaders = strings.Split(AllowBasicAuthHeaders, ",")
@@ -122,13 +290,79 @@ func init() {
 	if JwtOutboundHeader != "" {
 		httpserver.JwtOutboundHeader = JwtOutboundHeader
 	}
+	httpserver.ProcessConfig = map[string]interface{}{
+		"listen_port":             ListenPort,
+		"admin_port":              AdminPort,
+		"shutdown_timeout":        ShutdownTimeout.String(),
+		"log_level":               log.GetLevel().String(),
+		"sentry_dsn":              httpserver.Redact(os.Getenv("SENTRY_DSN")),
+		"sentry_environment":      os.Getenv("SENTRY_CURRENT_ENV"),
+		"replay_store_url":        httpserver.Redact(os.Getenv("REPLAY_STORE_URL")),
+		"replay_cache_size":       os.Getenv("REPLAY_CACHE_SIZE"),
+		"revocation_file":         os.Getenv("REVOCATION_FILE"),
+		"revocation_ttl":          revocation.DefaultTTL.String(),
+		"introspection_timeout":   introspection.Timeout.String(),
+		"decryption_key_files":    os.Getenv("DECRYPTION_KEY_FILES"),
+		"verification_cache_size": os.Getenv("VERIFICATION_CACHE_SIZE"),
+		"verification_cache_ttl":  os.Getenv("VERIFICATION_CACHE_TTL"),
+		"version":                 Version,
+	}
+	log.WithFields(log.Fields(httpserver.ProcessConfig)).Info("Starting ambassador-auth-jwt")
+}
+
+// durationEnv parses the env variable as a duration, falling back to def when it is unset or invalid
+func durationEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Warn(fmt.Sprintf("Unable to convert %s to duration, defaulting to %s", name, def))
+		return def
+	}
+	return d
 }
 
 func main() {
+	if tracing.Enabled() {
+		shutdown, err := tracing.Init(context.Background(), Version)
+		if err != nil {
+			log.WithField("err", err).Fatal("Unable to initialize tracing")
+		}
+		defer shutdown(context.Background())
+	}
 	issuers := make([]string, 0, len(JwtIssuer))
-	for _,issuer := range JwtIssuer {
-	    issuers = append(issuers, issuer)
+	for _, issuer := range JwtIssuer {
+		issuers = append(issuers, issuer)
 	}
 	server := httpserver.NewServer(issuers)
-	log.Fatal(server.Start(ListenPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if JwksRefreshInterval > 0 {
+		go server.RefreshKeysets(ctx, JwksRefreshInterval)
+	}
+	if RevocationFile != "" {
+		go httpserver.Revocations.WatchFile(ctx, RevocationFile, 30*time.Second)
+	}
+	go func() {
+		if err := server.StartAdmin(AdminPort); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	go func() {
+		if err := server.Start(ListenPort); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	sig := <-stop
+	log.WithField("signal", sig.String()).Info("Shutting down, waiting for in-flight requests to complete")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.WithField("err", err).Error("Unable to complete in-flight requests before SHUTDOWN_TIMEOUT")
+	}
 }
@@ -0,0 +1,245 @@
+package httpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/token"
+)
+
+var (
+	// AdminToken is the bearer token required by the /admin endpoints. The admin API is disabled when it is empty.
+	AdminToken = ""
+	// ProcessConfig holds settings read outside of this package, reported by /admin/config. Values must already be redacted.
+	ProcessConfig = map[string]interface{}{}
+)
+
+// redacted is shown in place of secrets
+const redacted = "REDACTED"
+
+// Redact hides a secret, leaving only whether it is set
+func Redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// KeyInfo describes a key of an issuer's keyset without its key material
+type KeyInfo struct {
+	KeyID     string `json:"kid"`
+	Type      string `json:"kty"`
+	Algorithm string `json:"alg,omitempty"`
+	Use       string `json:"use,omitempty"`
+}
+
+// KeySetInfo describes an issuer's keyset
+type KeySetInfo struct {
+	Issuer    string    `json:"issuer"`
+	FetchedAt time.Time `json:"fetched_at"`
+	Keys      []KeyInfo `json:"keys"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// registerAdmin adds the admin API to the mux when AdminToken is set
+func (server *Server) registerAdmin(mux *http.ServeMux) {
+	if AdminToken == "" {
+		return
+	}
+	mux.Handle("/admin/keysets", server.adminAuth(http.HandlerFunc(server.AdminKeysetsHandler)))
+	mux.Handle("/admin/keysets/refresh", server.adminAuth(http.HandlerFunc(server.AdminRefreshHandler)))
+	mux.Handle("/admin/config", server.adminAuth(http.HandlerFunc(server.AdminConfigHandler)))
+	mux.Handle("/admin/revocations", server.adminAuth(http.HandlerFunc(server.AdminRevocationsHandler)))
+}
+
+// adminAuth only lets requests carrying AdminToken as a bearer token through
+func (server *Server) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if AdminToken == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(AdminToken)) != 1 {
+			log.WithFields(log.Fields{
+				"remote_addr": r.RemoteAddr,
+				"path":        r.URL.Path,
+			}).Warn("Unauthorized admin request")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	body, _ := json.MarshalIndent(v, "", "  ")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// keyType returns the JWK key type of a key
+func keyType(key interface{}) string {
+	switch key.(type) {
+	case *rsa.PublicKey, *rsa.PrivateKey:
+		return "RSA"
+	case *ecdsa.PublicKey, *ecdsa.PrivateKey:
+		return "EC"
+	case []byte:
+		return "oct"
+	default:
+		return fmt.Sprintf("%T", key)
+	}
+}
+
+// keysetInfo describes the issuer's current keyset
+func (server *Server) keysetInfo(issuer string) KeySetInfo {
+	info := KeySetInfo{Issuer: issuer, Keys: []KeyInfo{}}
+	keyset, ok := server.Keys.Get(issuer)
+	if !ok {
+		return info
+	}
+	info.FetchedAt = keyset.FetchedAt
+	for _, key := range keyset.Keys.Keys {
+		info.Keys = append(info.Keys, KeyInfo{KeyID: key.KeyID, Type: keyType(key.Key), Algorithm: key.Algorithm, Use: key.Use})
+	}
+	return info
+}
+
+// AdminKeysetsHandler lists every configured issuer with the key ids and algorithms of its keyset and when it was fetched
+func (server *Server) AdminKeysetsHandler(w http.ResponseWriter, r *http.Request) {
+	keysets := []KeySetInfo{}
+	for _, issuer := range configuredIssuers() {
+		keysets = append(keysets, server.keysetInfo(issuer))
+	}
+	writeJSON(w, http.StatusOK, keysets)
+}
+
+// AdminRefreshHandler fetches the keyset of the issuer given in the issuer query parameter, or of every issuer, right away
+func (server *Server) AdminRefreshHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	issuers := configuredIssuers()
+	if issuer := r.URL.Query().Get("issuer"); issuer != "" {
+		found := false
+		for _, configured := range issuers {
+			found = found || configured == issuer
+		}
+		if !found {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown issuer"})
+			return
+		}
+		issuers = []string{issuer}
+	}
+	code := http.StatusOK
+	keysets := []KeySetInfo{}
+	for _, issuer := range issuers {
+		_, err := server.Keys.Refresh(r.Context(), issuer)
+		info := server.keysetInfo(issuer)
+		if err != nil {
+			code = http.StatusBadGateway
+			info.Error = err.Error()
+		}
+		log.WithFields(log.Fields{
+			"remote_addr": r.RemoteAddr,
+			"issuer":      issuer,
+			"err":         err,
+		}).Info("Keyset refresh requested through the admin API")
+		keysets = append(keysets, info)
+	}
+	writeJSON(w, code, keysets)
+}
+
+// effectiveConfig returns the settings in use, with secrets redacted
+func effectiveConfig() map[string]interface{} {
+	regex := func(re *regexp.Regexp) string {
+		if re == nil {
+			return ""
+		}
+		return re.String()
+	}
+	config := map[string]interface{}{
+		"check_exp":                    JwtCheckExp,
+		"jwt_outbound_header":          JwtOutboundHeader,
+		"allow_basic_auth_passthrough": AllowBasicAuthPassThrough,
+		"allow_basic_auth_headers":     AllowBasicAuthHeaders,
+		"allow_basic_auth_path_regex":  regex(AllowBasicAuthPathRegex),
+		"new_error_message_regex":      regex(NewErrorMessageRegex),
+		"cors":                         DefaultCORS,
+		"token_sources":                DefaultTokenSources,
+		"jwks_refresh_interval":        JwksRefreshInterval.String(),
+		"jwks_max_age":                 JwksMaxAge.String(),
+		"read_timeout":                 ReadTimeout.String(),
+		"read_header_timeout":          ReadHeaderTimeout.String(),
+		"write_timeout":                WriteTimeout.String(),
+		"idle_timeout":                 IdleTimeout.String(),
+		"max_header_bytes":             MaxHeaderBytes,
+		"tls_cert_file":                TLSCertFile,
+		"tls_key_file":                 TLSKeyFile,
+		"tls_client_ca_file":           TLSClientCAFile,
+		"tls_min_version":              tlsVersionName(TLSMinVersion),
+		"admin_token":                  Redact(AdminToken),
+		"replay_ttl":                   ReplayTTL.String(),
+		"issuer_retry_min":             IssuerRetryMin.String(),
+		"issuer_retry_max":             IssuerRetryMax.String(),
+		"jwks_timeout":                 token.DefaultTimeout.String(),
+		"jwks_min_refresh_interval":    token.MinRefreshInterval.String(),
+		"jwks_clients":                 jwksClients(),
+		"jwks_cache_dir":               token.CacheDir,
+		"jwks_cache_max_age":           token.CacheMaxAge.String(),
+		"jwks_max_size":                token.MaxKeySetSize,
+		"jwks_min_rsa_bits":            token.MinRSAKeySize,
+		"explain_secret":               Redact(ExplainSecret),
+		"explain_all":                  ExplainAll,
+	}
+	for k, v := range ProcessConfig {
+		config[k] = v
+	}
+	return config
+}
+
+// jwksClients returns the per issuer JWKS client settings with the header values and proxy password redacted
+func jwksClients() map[string]token.ClientConfig {
+	clients := make(map[string]token.ClientConfig, len(token.Clients))
+	for issuer, config := range token.Clients {
+		headers := make(map[string]string, len(config.Headers))
+		for name, value := range config.Headers {
+			headers[name] = Redact(value)
+		}
+		config.Headers = headers
+		config.ProxyURL = redactURL(config.ProxyURL)
+		clients[issuer] = config
+	}
+	return clients
+}
+
+// redactURL hides the password of the url's userinfo, the whole url when it can not be parsed
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return Redact(raw)
+	}
+	if password, ok := u.User.Password(); ok && password != "" {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
+
+// AdminConfigHandler dumps the effective configuration, with secrets redacted, and the route table
+func (server *Server) AdminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"config":  effectiveConfig(),
+		"issuers": JwtIssuer,
+		"routes":  Routes,
+	})
+}
@@ -0,0 +1,177 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CORS configures the Cross-Origin Resource Sharing headers returned for a route
+type CORS struct {
+	// AllowedOrigins lists the origins allowed to make cross-origin requests. "*" allows any origin.
+	AllowedOrigins []string `json:"allowed_origins,omitempty"`
+	// AllowedOriginRegex allows every origin matching the regex, on top of AllowedOrigins
+	AllowedOriginRegex string `json:"allowed_origin_regex,omitempty"`
+	// AllowCredentials lets browsers send cookies and authorization headers. The request's origin is echoed back instead of "*".
+	// It can not be set when AllowedOrigins holds "*".
+	AllowCredentials bool `json:"allow_credentials,omitempty"`
+	// AllowedMethods is returned in Access-Control-Allow-Methods on preflight requests
+	AllowedMethods []string `json:"allowed_methods,omitempty"`
+	// AllowedHeaders is returned in Access-Control-Allow-Headers on preflight requests
+	AllowedHeaders []string `json:"allowed_headers,omitempty"`
+	// ExposedHeaders is returned in Access-Control-Expose-Headers
+	ExposedHeaders []string `json:"exposed_headers,omitempty"`
+	// MaxAge is the number of seconds browsers may cache a preflight response
+	MaxAge int `json:"max_age,omitempty"`
+	// StrictPreflight only lets real preflight requests (OPTIONS with Origin and Access-Control-Request-Method headers) through without a token.
+	// Other OPTIONS requests have to be authenticated like any other method.
+	StrictPreflight bool `json:"strict_preflight,omitempty"`
+}
+
+// DefaultCORS is used for routes without their own CORS settings. It allows every origin.
+var DefaultCORS = CORS{
+	AllowedOrigins: []string{"*"},
+	AllowedMethods: []string{"GET", "POST", "DELETE", "PUT", "OPTIONS"},
+	AllowedHeaders: []string{"authorization"},
+	MaxAge:         1728000,
+}
+
+// UnmarshalJSON parses the CORS settings and validates them, so that invalid settings are reported at startup
+func (c *CORS) UnmarshalJSON(data []byte) error {
+	type plain CORS
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+	return c.compile().err
+}
+
+// corsKey holds the settings a compiledCORS depends on
+type corsKey struct {
+	originRegex          string
+	credentialsAnyOrigin bool
+}
+
+// compiledCORS is the result of validating CORS settings and compiling their AllowedOriginRegex
+type compiledCORS struct {
+	originRegex *regexp.Regexp
+	err         error
+}
+
+// corsCache holds a compiledCORS for every corsKey used, so that settings built in Go, e.g. DefaultCORS, are compiled
+// and validated on first use like those parsed from JSON
+var corsCache sync.Map
+
+// compile validates the settings and compiles AllowedOriginRegex. Credentials can not be allowed for any origin, since
+// every site could then make authenticated requests on behalf of the user.
+func (c *CORS) compile() compiledCORS {
+	key := corsKey{originRegex: c.AllowedOriginRegex, credentialsAnyOrigin: c.AllowCredentials && c.allowAny()}
+	if cached, ok := corsCache.Load(key); ok {
+		return cached.(compiledCORS)
+	}
+	compiled := compiledCORS{}
+	if key.credentialsAnyOrigin {
+		compiled.err = fmt.Errorf("allow_credentials can not be used with the \"*\" allowed origin")
+	} else if key.originRegex != "" {
+		re, err := regexp.Compile(key.originRegex)
+		if err != nil {
+			compiled.err = fmt.Errorf("invalid allowed_origin_regex: %s", err)
+		}
+		compiled.originRegex = re
+	}
+	cached, _ := corsCache.LoadOrStore(key, compiled)
+	return cached.(compiledCORS)
+}
+
+// corsFor returns the CORS settings of a route
+func corsFor(route Route) *CORS {
+	if route.CORS != nil {
+		return route.CORS
+	}
+	return &DefaultCORS
+}
+
+// isPreflight reports whether the request is a CORS preflight request
+func isPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// allowAny reports whether any origin is allowed
+func (c *CORS) allowAny() bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// originAllowed reports whether the origin may make cross-origin requests
+func (c *CORS) originAllowed(origin string, originRegex *regexp.Regexp) bool {
+	if c.allowAny() {
+		return true
+	}
+	for _, o := range c.AllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return originRegex != nil && originRegex.MatchString(origin)
+}
+
+// skipsAuth reports whether the OPTIONS request is answered without checking for a token
+func (c *CORS) skipsAuth(r *http.Request) bool {
+	if r.Method != "OPTIONS" {
+		return false
+	}
+	return !c.StrictPreflight || isPreflight(r)
+}
+
+// apply sets the CORS headers of the response. Invalid settings set none, so that browsers block cross-origin requests.
+func (c *CORS) apply(h http.Header, r *http.Request) {
+	compiled := c.compile()
+	if compiled.err != nil {
+		log.WithField("err", compiled.err).Error("Invalid CORS settings, cross-origin requests are not allowed")
+		return
+	}
+	origin := r.Header.Get("Origin")
+	// The response depends on the origin unless every origin gets the same "*"
+	wildcard := c.allowAny() && !c.AllowCredentials
+	if !wildcard {
+		h.Add("Vary", "Origin")
+	}
+	if isPreflight(r) {
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+	switch {
+	case wildcard:
+		h.Set("Access-Control-Allow-Origin", "*")
+	case origin != "" && c.originAllowed(origin, compiled.originRegex):
+		h.Set("Access-Control-Allow-Origin", origin)
+		if c.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+	default:
+		return
+	}
+	if len(c.ExposedHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+	}
+	if r.Method == "OPTIONS" {
+		if len(c.AllowedMethods) > 0 {
+			h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+		}
+		if len(c.AllowedHeaders) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+		}
+		if c.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/introspection"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/token"
+)
+
+// Error codes defined by RFC 6750 for the WWW-Authenticate header
+const (
+	errInvalidToken      = "invalid_token"
+	errInsufficientScope = "insufficient_scope"
+)
+
+// Reason codes returned in error bodies so clients can tell why a request was rejected
+const (
+	ReasonTokenMissing             = "token_missing"
+	ReasonTokenMalformed           = "token_malformed"
+	ReasonDecryptionFailed         = "decryption_failed"
+	ReasonTokenExpired             = "token_expired"
+	ReasonTokenInvalid             = "token_invalid"
+	ReasonSignatureInvalid         = "signature_invalid"
+	ReasonUnknownKid               = "unknown_kid"
+	ReasonIssuerNotFound           = "issuer_not_found"
+	ReasonIssuerUnavailable        = "issuer_unavailable"
+	ReasonTokenInactive            = "token_inactive"
+	ReasonIntrospectionUnavailable = "introspection_unavailable"
+	ReasonInsufficientScope        = "insufficient_scope"
+	ReasonInvalidAudience          = "invalid_audience"
+	ReasonTokenRevoked             = "token_revoked"
+	ReasonTokenReplayed            = "token_replayed"
+	ReasonReplayUnavailable        = "replay_check_unavailable"
+)
+
+// Error body formats that can be selected per route with Route.ErrorFormat
+const (
+	// ErrorFormatLegacy is the original {"code": "unauthorized", "message": "..."} body
+	ErrorFormatLegacy = "legacy"
+	// ErrorFormatDefault is the ErrorMsg body
+	ErrorFormatDefault = "default"
+	// ErrorFormatProblem is an RFC 7807 application/problem+json body
+	ErrorFormatProblem = "problem"
+	// ErrorFormatTemplate renders Route.ErrorTemplate
+	ErrorFormatTemplate = "template"
+)
+
+// Problem is the RFC 7807 body returned with ErrorFormatProblem
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+}
+
+// ErrorTemplateData is passed to Route.ErrorTemplate when rendering an error body
+type ErrorTemplateData struct {
+	// Status is the http status code of the response
+	Status int
+	// Code is the reason code, e.g. token_expired
+	Code string
+	// Error is the RFC 6750 error code, e.g. invalid_token
+	Error string
+	// Message is a human readable explanation of the error
+	Message string
+	// Path is the path of the request
+	Path string
+}
+
+// templateFuncs are available in error templates. json encodes a value so it can be safely embedded in a json document.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// authError describes why a request was rejected and how the rejection is reported to the client
+type authError struct {
+	// Status is the http status code returned, 401 for authentication failures, 403 for authorization failures
+	// and 503 when the token can not be checked yet
+	Status int
+	// Code is the RFC 6750 error code. It is left empty when the request did not carry any credentials.
+	Code string
+	// Reason is the machine readable reason code returned in the error body
+	Reason string
+	// Description is a human readable explanation sent in the error_description attribute and the error body
+	Description string
+	// Scope lists the scopes needed to access the resource, only set for insufficient_scope errors
+	Scope []string
+
+	// detail is logged instead of Description when set, e.g. the error returned by token.Decode
+	detail string
+}
+
+func (e *authError) Error() string {
+	return e.Description
+}
+
+// withDetail sets the message logged for the error
+func (e *authError) withDetail(detail string) *authError {
+	e.detail = detail
+	return e
+}
+
+// logMessage returns the message logged for the error
+func (e *authError) logMessage() string {
+	if e.detail != "" {
+		return e.detail
+	}
+	return e.Description
+}
+
+// newAuthError returns the error for a reason code, deriving the status and RFC 6750 code from it
+func newAuthError(reason string, description string) *authError {
+	switch reason {
+	case ReasonTokenMissing:
+		return &authError{Status: http.StatusUnauthorized, Reason: reason, Description: description}
+	case ReasonInsufficientScope:
+		return &authError{Status: http.StatusForbidden, Code: errInsufficientScope, Reason: reason, Description: description}
+	case ReasonIssuerUnavailable, ReasonReplayUnavailable, ReasonIntrospectionUnavailable:
+		return &authError{Status: http.StatusServiceUnavailable, Reason: reason, Description: description}
+	default:
+		return &authError{Status: http.StatusUnauthorized, Code: errInvalidToken, Reason: reason, Description: description}
+	}
+}
+
+// decodeError maps an error returned by token.Decode to the reason it is reported with
+func decodeError(err error) *authError {
+	switch {
+	case errors.Is(err, token.ErrIssuerUnavailable):
+		return newAuthError(ReasonIssuerUnavailable, "The issuer's keys are not available yet, retry later")
+	case errors.Is(err, introspection.ErrInactive):
+		return newAuthError(ReasonTokenInactive, "The access token is not active")
+	case errors.Is(err, introspection.ErrUnavailable):
+		return newAuthError(ReasonIntrospectionUnavailable, "The access token could not be introspected, retry later")
+	case errors.Is(err, token.ErrDecryptionFailed):
+		return newAuthError(ReasonDecryptionFailed, "The access token could not be decrypted")
+	case errors.Is(err, token.ErrMalformed):
+		return newAuthError(ReasonTokenMalformed, "The access token is malformed")
+	case errors.Is(err, token.ErrUnknownKid):
+		return newAuthError(ReasonUnknownKid, "The access token was signed by an unknown key")
+	case errors.Is(err, token.ErrSignatureInvalid):
+		return newAuthError(ReasonSignatureInvalid, "The access token signature is invalid")
+	case errors.Is(err, token.ErrAlgorithm):
+		return newAuthError(ReasonTokenInvalid, "The access token is signed with an algorithm that is not accepted")
+	case errors.Is(err, token.ErrNotValidYet):
+		return newAuthError(ReasonTokenInvalid, "The access token is not valid yet")
+	default:
+		return newAuthError(ReasonTokenInvalid, "The access token is invalid")
+	}
+}
+
+// forbidden returns a 403 error for a valid token that is not allowed to access the resource
+func forbidden(description string, scope []string) *authError {
+	e := newAuthError(ReasonInsufficientScope, description)
+	e.Scope = scope
+	return e
+}
+
+// wwwAuthenticate builds the value of the WWW-Authenticate header as described in RFC 6750 section 3
+func (e *authError) wwwAuthenticate() string {
+	if e.Code == "" {
+		return "Bearer"
+	}
+	attrs := []string{fmt.Sprintf("error=%q", e.Code)}
+	if e.Description != "" {
+		attrs = append(attrs, fmt.Sprintf("error_description=%q", e.Description))
+	}
+	if len(e.Scope) > 0 {
+		attrs = append(attrs, fmt.Sprintf("scope=%q", strings.Join(e.Scope, " ")))
+	}
+	return "Bearer " + strings.Join(attrs, ", ")
+}
+
+// body returns the content type and error body returned to the client in the format selected by the route.
+// Routes without a format get ErrorMsg on paths matching NewErrorMessageRegex and the legacy body on the others.
+func (e *authError) body(r *http.Request, route Route) (string, []byte) {
+	format := route.ErrorFormat
+	if format == "" {
+		format = ErrorFormatLegacy
+		if NewErrorMessageRegex.Match([]byte(r.URL.Path)) {
+			format = ErrorFormatDefault
+		}
+	}
+	var body []byte
+	switch format {
+	case ErrorFormatTemplate:
+		rendered, err := e.render(r, route)
+		if err == nil {
+			contentType := route.ErrorContentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			return contentType, rendered
+		}
+		log.WithField("path", r.URL.Path).Error("Unable to render error template: " + err.Error())
+		fallthrough
+	case ErrorFormatDefault:
+		body, _ = json.Marshal(ErrorMsg{
+			StatusCode: e.Status,
+			Errors:     []Error{{Code: e.Reason, Message: e.Description}},
+		})
+	case ErrorFormatProblem:
+		body, _ = json.Marshal(Problem{
+			Type:     "about:blank",
+			Title:    http.StatusText(e.Status),
+			Status:   e.Status,
+			Detail:   e.Description,
+			Instance: r.URL.Path,
+			Code:     e.Reason,
+		})
+		return "application/problem+json", body
+	default:
+		code, message := "unauthorized", "You are not authorized to perform the requested action"
+		switch e.Status {
+		case http.StatusForbidden:
+			code, message = "forbidden", "You do not have permission to perform the requested action"
+		case http.StatusServiceUnavailable:
+			code, message = "unavailable", "The service is temporarily unavailable, please retry later"
+		}
+		body, _ = json.Marshal(map[string]string{"code": code, "message": message})
+	}
+	return "application/json", body
+}
+
+// render executes the route's error template
+func (e *authError) render(r *http.Request, route Route) ([]byte, error) {
+	if route.errorTemplate == nil {
+		if err := route.compile(); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	err := route.errorTemplate.Execute(&buf, ErrorTemplateData{
+		Status:  e.Status,
+		Code:    e.Reason,
+		Error:   e.Code,
+		Message: e.Description,
+		Path:    r.URL.Path,
+	})
+	return buf.Bytes(), err
+}
+
+// writeError sends the WWW-Authenticate header and error body for a rejected request
+func writeError(w http.ResponseWriter, r *http.Request, e *authError) {
+	_, route := getRoute(r)
+	contentType, body := e.body(r, route)
+	if e.Status != http.StatusServiceUnavailable {
+		w.Header().Set("WWW-Authenticate", e.wwwAuthenticate())
+	} else if e.Reason == ReasonIssuerUnavailable {
+		// The issuer is retried after IssuerRetryMin
+		w.Header().Set("Retry-After", fmt.Sprintf("%.0f", IssuerRetryMin.Seconds()))
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	w.Write(body)
+}
@@ -0,0 +1,70 @@
+package httpserver
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ExplainHeader is the request header carrying ExplainSecret to ask for the decision to be explained
+	ExplainHeader = "X-Auth-Explain"
+	// ExplanationHeader is the response header the Explanation is returned in, as json
+	ExplanationHeader = "X-Auth-Explanation"
+)
+
+var (
+	// ExplainSecret explains the decisions of requests sending it in ExplainHeader. It is disabled when empty.
+	ExplainSecret = ""
+	// ExplainAll explains every decision. It exposes why tokens are rejected to anyone and is meant for non production environments.
+	ExplainAll = false
+)
+
+// Explanation describes how a decision was made, stage by stage. It never holds the token itself.
+type Explanation struct {
+	// Decision is allow or deny
+	Decision string `json:"decision"`
+	// Reason is the reason code of the decision
+	Reason string `json:"reason"`
+	// Route is the key of the request's route in Routes, empty when it has none
+	Route string `json:"route"`
+	// Issuer is the issuer the token was checked against
+	Issuer string `json:"issuer,omitempty"`
+	// Steps are the stages run, with what each of them checked
+	Steps []Step `json:"steps"`
+}
+
+// explainRequested reports whether the decision about the request is explained
+func explainRequested(r *http.Request) bool {
+	if ExplainAll {
+		return true
+	}
+	if ExplainSecret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(ExplainHeader)), []byte(ExplainSecret)) == 1
+}
+
+// Note records what the running stage checked, e.g. a claim and its value, in the decision trace. Notes are kept when the
+// decision is explained or debug logging is enabled, and dropped otherwise.
+func (req *AuthRequest) Note(key string, value string) {
+	if !req.Explain && !log.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+	if req.notes == nil {
+		req.notes = map[string]string{}
+	}
+	req.notes[key] = value
+}
+
+// explanation returns the explanation of the decision
+func (req *AuthRequest) explanation(decision string) Explanation {
+	return Explanation{
+		Decision: decision,
+		Reason:   req.Reason,
+		Route:    req.RoutePath,
+		Issuer:   req.Issuer,
+		Steps:    req.Trace,
+	}
+}
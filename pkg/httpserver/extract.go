@@ -0,0 +1,106 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Token source types
+const (
+	TokenSourceHeader = "header"
+	TokenSourceCookie = "cookie"
+	TokenSourceQuery  = "query"
+)
+
+// TokenSource tells where to look for a token in a request
+type TokenSource struct {
+	// Type is header, cookie or query
+	Type string `json:"type"`
+	// Name is the name of the header, cookie or query parameter
+	Name string `json:"name"`
+	// Prefix is removed from the value when present, e.g. "Bearer ". Values using another authorization scheme (e.g. "Basic ...") are ignored.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// DefaultTokenSources is used for routes without their own token sources.
+// It reads the Authorization header, then the token and bearer_token query parameters.
+var DefaultTokenSources = []TokenSource{
+	{Type: TokenSourceHeader, Name: "Authorization", Prefix: "Bearer "},
+	{Type: TokenSourceQuery, Name: "token"},
+	{Type: TokenSourceQuery, Name: "bearer_token"},
+}
+
+// UnmarshalJSON parses the token source and checks its type
+func (source *TokenSource) UnmarshalJSON(data []byte) error {
+	type plain TokenSource
+	if err := json.Unmarshal(data, (*plain)(source)); err != nil {
+		return err
+	}
+	switch source.Type {
+	case TokenSourceHeader, TokenSourceCookie, TokenSourceQuery:
+	default:
+		return fmt.Errorf("unknown token source type %q", source.Type)
+	}
+	if source.Name == "" {
+		return fmt.Errorf("token source of type %s has no name", source.Type)
+	}
+	return nil
+}
+
+func (source TokenSource) String() string {
+	return source.Type + " " + source.Name
+}
+
+// describeSources lists the sources for log messages
+func describeSources(sources []TokenSource) string {
+	names := make([]string, 0, len(sources))
+	for _, source := range sources {
+		names = append(names, source.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// value returns the token found in the source, or an empty string
+func (source TokenSource) value(r *http.Request) string {
+	var value string
+	switch source.Type {
+	case TokenSourceHeader:
+		value = r.Header.Get(source.Name)
+	case TokenSourceCookie:
+		if cookie, err := r.Cookie(source.Name); err == nil {
+			value = cookie.Value
+		}
+	case TokenSourceQuery:
+		value = r.URL.Query().Get(source.Name)
+	}
+	value = strings.TrimSpace(value)
+	if source.Prefix != "" {
+		if len(value) >= len(source.Prefix) && strings.EqualFold(value[:len(source.Prefix)], source.Prefix) {
+			return strings.TrimSpace(value[len(source.Prefix):])
+		}
+		if strings.Contains(value, " ") {
+			return ""
+		}
+	}
+	return value
+}
+
+// tokenSourcesFor returns the token sources of a route
+func tokenSourcesFor(route Route) []TokenSource {
+	if len(route.TokenSources) > 0 {
+		return route.TokenSources
+	}
+	return DefaultTokenSources
+}
+
+// extractToken returns the first token found in the sources, in order, and the source it was found in
+func extractToken(r *http.Request, sources []TokenSource) (string, TokenSource, bool) {
+	for _, source := range sources {
+		if value := source.value(r); value != "" {
+			return value, source, true
+		}
+	}
+	return "", TokenSource{}, false
+}
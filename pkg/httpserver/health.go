@@ -0,0 +1,166 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// JwksRefreshInterval is how often every issuer's keyset is fetched again in the background
+	JwksRefreshInterval = time.Hour
+	// JwksMaxAge is how old a keyset can get before the service is reported as not ready. Zero disables the check.
+	JwksMaxAge = 24 * time.Hour
+	// IssuerRetryMin is the delay before retrying an issuer that could not be initialized. It doubles after each failure.
+	IssuerRetryMin = time.Second
+	// IssuerRetryMax caps the delay between retries of an issuer
+	IssuerRetryMax = 5 * time.Minute
+)
+
+// IssuerStatus is reported by /readyz for every configured issuer
+type IssuerStatus struct {
+	Ready     bool       `json:"ready"`
+	Keys      int        `json:"keys"`
+	FetchedAt *time.Time `json:"fetched_at,omitempty"`
+	// Cached is set while the keyset loaded from the cache at startup was not fetched from the issuer again
+	Cached bool   `json:"cached,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// configuredIssuers returns the issuers of JwtIssuer, sorted and without duplicates
+func configuredIssuers() []string {
+	seen := map[string]bool{}
+	issuers := []string{}
+	for _, issuer := range JwtIssuer {
+		if !seen[issuer] {
+			seen[issuer] = true
+			issuers = append(issuers, issuer)
+		}
+	}
+	sort.Strings(issuers)
+	return issuers
+}
+
+// Readiness reports whether every configured issuer with a keyset has a non-empty one fetched less than JwksMaxAge ago.
+// Keysets loaded from the cache are accepted whatever their age, up to token.CacheMaxAge, until the issuer is fetched
+// again. Issuers whose keyset was never fetched are being retried: they are reported, but only make the service not ready
+// when no issuer is ready at all. Without issuers, e.g. when every route uses introspection, the service is ready. The
+// service is never ready once it is shutting down.
+func (server *Server) Readiness() (bool, map[string]IssuerStatus) {
+	server.mu.Lock()
+	ready := !server.draining
+	server.mu.Unlock()
+	statuses := map[string]IssuerStatus{}
+	issuers := configuredIssuers()
+	anyReady := len(issuers) == 0
+	for _, issuer := range issuers {
+		status := IssuerStatus{}
+		keyset, ok := server.Keys.Get(issuer)
+		switch {
+		case !ok:
+			status.Reason = "keyset was never fetched"
+			statuses[issuer] = status
+			continue
+		case len(keyset.Keys.Keys) == 0:
+			status.Reason = "keyset is empty"
+		case JwksMaxAge > 0 && !keyset.FromCache && time.Since(keyset.FetchedAt) > JwksMaxAge:
+			status.Reason = fmt.Sprintf("keyset is older than %s", JwksMaxAge)
+		default:
+			status.Ready = true
+		}
+		if ok {
+			fetchedAt := keyset.FetchedAt
+			status.FetchedAt = &fetchedAt
+			status.Keys = len(keyset.Keys.Keys)
+			status.Cached = keyset.FromCache
+		}
+		ready = ready && status.Ready
+		anyReady = anyReady || status.Ready
+		statuses[issuer] = status
+	}
+	return ready && anyReady, statuses
+}
+
+// HealthzHandler reports that the process is alive
+func (server *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// ReadyzHandler returns a 200 when the service can check tokens, a 503 otherwise
+func (server *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready, statuses := server.Readiness()
+	status := "ok"
+	code := http.StatusOK
+	if !ready {
+		status = "unavailable"
+		code = http.StatusServiceUnavailable
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"status":  status,
+		"issuers": statuses,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// RefreshKeysets fetches the keyset of every configured issuer each interval, until the context is done.
+// The previous keyset is kept when a fetch fails, so a short outage of an issuer does not reject valid tokens.
+func (server *Server) RefreshKeysets(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, issuer := range configuredIssuers() {
+				if _, err := server.Keys.Refresh(ctx, issuer); err != nil {
+					log.WithFields(log.Fields{
+						"issuer": issuer,
+						"err":    err,
+					}).Error("Unable to refresh keyset")
+				}
+			}
+		}
+	}
+}
+
+// retryIssuer fetches the issuer's keyset with exponential backoff, from IssuerRetryMin to IssuerRetryMax,
+// until it succeeds, the keyset is fetched elsewhere, or the context is done
+func (server *Server) retryIssuer(ctx context.Context, issuer string) {
+	delay := IssuerRetryMin
+	started := time.Now()
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if keyset, ok := server.Keys.Get(issuer); ok && keyset.FetchedAt.After(started) {
+			return
+		}
+		if _, err := server.Keys.Refresh(ctx, issuer); err == nil {
+			log.WithField("issuer", issuer).Info("Issuer keyset retrieved, its routes are now served")
+			return
+		} else if ctx.Err() == nil {
+			log.WithFields(log.Fields{
+				"issuer": issuer,
+				"err":    err,
+				"retry":  delay.String(),
+			}).Warn("Unable to retrieve keyset")
+		}
+		delay *= 2
+		if delay > IssuerRetryMax {
+			delay = IssuerRetryMax
+		}
+	}
+}
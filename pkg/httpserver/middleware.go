@@ -0,0 +1,55 @@
+package httpserver
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/token"
+)
+
+type contextKey int
+
+const claimsKey contextKey = iota
+
+// Middleware verifies the requests' tokens before passing them to next, for services that are not behind Ambassador.
+// The issuers, routes, revocations and basic auth settings apply as they do to DecodeHTTPHandler, and rejected requests
+// get the same error responses without reaching next. The claims of verified tokens are stored in the request context,
+// see ClaimsFromContext, and the upstream headers set by the stages, e.g. JwtOutboundHeader, are added to the request.
+// JwtOutboundHeader and ExplainHeader are removed from the incoming request first, so that clients can not forge them
+// on requests let through without a token. CORS preflight requests are answered without reaching next.
+func (server *Server) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, allowed := server.authorize(w, r)
+		if !allowed || req.Reason == "cors_preflight" {
+			return
+		}
+		if req.Claims != nil {
+			r = r.WithContext(context.WithValue(r.Context(), claimsKey, req.Claims))
+		}
+		r.Header.Del(ExplainHeader)
+		r.Header.Del(JwtOutboundHeader)
+		for name, values := range req.UpstreamHeader {
+			r.Header[name] = values
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClaimsFromContext returns the claims of the token verified by Middleware. It returns false when the request was let
+// through without a token, with basic auth. The claims are a copy for the request, handlers may modify them.
+func ClaimsFromContext(ctx context.Context) (token.Claims, bool) {
+	claims, ok := ctx.Value(claimsKey).(token.Claims)
+	return claims, ok
+}
+
+// SubjectFromContext returns the subject of the token verified by Middleware, or an empty string
+func SubjectFromContext(ctx context.Context) string {
+	claims, _ := ClaimsFromContext(ctx)
+	return claims.Subject()
+}
+
+// ScopesFromContext returns the scopes granted by the token verified by Middleware, from its scope or scp claim
+func ScopesFromContext(ctx context.Context) []string {
+	claims, _ := ClaimsFromContext(ctx)
+	return grantedScopes(claims)
+}
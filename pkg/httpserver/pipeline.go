@@ -0,0 +1,204 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/token"
+)
+
+// Verdict is what a Stage decides about a request it does not deny
+type Verdict int
+
+const (
+	// Continue passes the request to the next stage
+	Continue Verdict = iota
+	// Allow lets the request through without running the next stages
+	Allow
+)
+
+// Results of the stages in a decision trace
+const (
+	StepContinue = "continue"
+	StepAllow    = "allow"
+	StepDeny     = "deny"
+	// StepShadowDeny is the result of a stage in shadow mode that would have denied the request
+	StepShadowDeny = "shadow_deny"
+)
+
+// AuthRequest is a request going through the pipeline. Stages read it and fill it in.
+type AuthRequest struct {
+	// Request is the request being authorized
+	Request *http.Request
+	// RoutePath is the key of the request's route in Routes, empty when it has none
+	RoutePath string
+	// Route holds the settings of the request's route
+	Route Route
+	// Issuer is the url of the keyset tokens are verified with, empty when no issuer is configured for the path.
+	// It is the introspection url once a token is introspected.
+	Issuer string
+	// Token is the raw token, once extracted
+	Token string
+	// TokenSource is where the token was found
+	TokenSource TokenSource
+	// Claims are the token's claims, once verified. They are the request's own copy, stages may modify them.
+	Claims token.Claims
+	// KeyID is the key id of the verified token, empty for introspected tokens
+	KeyID string
+	// Introspected is set when the token was checked by the route's introspection endpoint
+	Introspected bool
+	// ResponseHeader holds the headers sent to the client, whether the request is allowed or not, e.g. CORS headers
+	ResponseHeader http.Header
+	// UpstreamHeader holds the headers added to allowed requests, e.g. JwtOutboundHeader
+	UpstreamHeader http.Header
+	// Fields are added to the log line of the decision
+	Fields log.Fields
+	// Reason is the reason code of the decision: token_valid, the reason of a stage allowing the request early, or the
+	// reason it was denied with
+	Reason string
+	// Trace lists the stages run and their results
+	Trace []Step
+	// Explain is set when the decision is explained, see ExplainSecret
+	Explain bool
+
+	debugLogger *log.Entry
+	// notes are the notes of the running stage
+	notes map[string]string
+}
+
+// Step is the result of a stage in a decision trace
+type Step struct {
+	Stage string `json:"stage"`
+	// Result is continue, allow, deny or shadow_deny
+	Result string `json:"result"`
+	// Reason is the reason code of the stage allowing or denying the request
+	Reason string `json:"reason,omitempty"`
+	// Detail explains a denial
+	Detail string `json:"detail,omitempty"`
+	// Notes tell what the stage checked, see AuthRequest.Note
+	Notes    map[string]string `json:"notes,omitempty"`
+	Duration time.Duration     `json:"duration"`
+}
+
+// Stage is a step of the decision pipeline. Stages run in order until one denies or allows the request.
+type Stage interface {
+	// Name identifies the stage in decision traces and Pipeline.Insert
+	Name() string
+	// Run checks or enriches the request, e.g. by adding claims or upstream headers. It denies the request by returning an
+	// error, see Reject and Forbid.
+	Run(ctx context.Context, req *AuthRequest) (Verdict, error)
+}
+
+type funcStage struct {
+	name string
+	run  func(ctx context.Context, req *AuthRequest) (Verdict, error)
+}
+
+// StageFunc returns a Stage named name running the function
+func StageFunc(name string, run func(ctx context.Context, req *AuthRequest) (Verdict, error)) Stage {
+	return funcStage{name: name, run: run}
+}
+
+func (s funcStage) Name() string {
+	return s.name
+}
+
+func (s funcStage) Run(ctx context.Context, req *AuthRequest) (Verdict, error) {
+	return s.run(ctx, req)
+}
+
+// Reject returns the error a Stage denies a request with. The reason codes of this package keep their status, others
+// are reported as 401 invalid_token.
+func Reject(reason string, description string) error {
+	return newAuthError(reason, description)
+}
+
+// Forbid returns the error a Stage denies a valid token that is not allowed on the route with, reported as 403. The
+// WWW-Authenticate error is insufficient_scope for ReasonInsufficientScope and invalid_token for other reasons.
+func Forbid(reason string, description string) error {
+	e := forbidden(description, nil)
+	e.Reason = reason
+	if reason != ReasonInsufficientScope {
+		e.Code = errInvalidToken
+	}
+	return e
+}
+
+// Pipeline is an ordered list of stages
+type Pipeline []Stage
+
+// Insert returns a copy of the pipeline with the stages inserted before the stage named before, or appended when there
+// is no such stage
+func (p Pipeline) Insert(before string, stages ...Stage) Pipeline {
+	inserted := make(Pipeline, 0, len(p)+len(stages))
+	done := false
+	for _, stage := range p {
+		if !done && stage.Name() == before {
+			inserted = append(inserted, stages...)
+			done = true
+		}
+		inserted = append(inserted, stage)
+	}
+	if !done {
+		inserted = append(inserted, stages...)
+	}
+	return inserted
+}
+
+// Names returns the names of the stages, in order
+func (p Pipeline) Names() []string {
+	names := make([]string, 0, len(p))
+	for _, stage := range p {
+		names = append(names, stage.Name())
+	}
+	return names
+}
+
+// run passes the request through the stages, recording their results in the trace. It returns the error of the stage
+// denying the request, if any. Stages in shadow mode on the request's route can neither deny nor allow it.
+func (p Pipeline) run(ctx context.Context, req *AuthRequest) *authError {
+	for _, stage := range p {
+		start := time.Now()
+		req.notes = nil
+		reason := req.Reason
+		verdict, err := stage.Run(ctx, req)
+		step := Step{Stage: stage.Name(), Result: StepContinue, Notes: req.notes, Duration: time.Since(start)}
+		if req.Route.shadows(step.Stage) {
+			req.Reason = reason
+			if err != nil {
+				e := asAuthError(err)
+				step.Result, step.Reason, step.Detail = StepShadowDeny, e.Reason, e.logMessage()
+			}
+			req.Trace = append(req.Trace, step)
+			continue
+		}
+		if err != nil {
+			e := asAuthError(err)
+			step.Result, step.Reason, step.Detail = StepDeny, e.Reason, e.logMessage()
+			req.Reason = e.Reason
+			req.Trace = append(req.Trace, step)
+			return e
+		}
+		if verdict == Allow {
+			step.Result, step.Reason = StepAllow, req.Reason
+			req.Trace = append(req.Trace, step)
+			return nil
+		}
+		req.Trace = append(req.Trace, step)
+	}
+	return nil
+}
+
+// asAuthError returns the authError a stage denied a request with. Other errors are reported like token.Decode errors.
+func asAuthError(err error) *authError {
+	e := &authError{}
+	if errors.As(err, &e) {
+		return e
+	}
+	e = decodeError(err)
+	e.detail = err.Error()
+	return e
+}
@@ -0,0 +1,43 @@
+package httpserver
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/replay"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/token"
+)
+
+var (
+	// ReplayStore records the jti of the tokens used on routes with replay protection
+	ReplayStore replay.Store = replay.NewMemoryStore(100000)
+	// ReplayTTL is the minimum time the jti of a token is remembered, so that tokens without expiration, or already
+	// expired when expiration is not enforced, can not be used again
+	ReplayTTL = 24 * time.Hour
+)
+
+// checkReplay records the token's jti until the token expires, or for ReplayTTL when that is later, and rejects it when
+// it was already recorded
+func checkReplay(ctx context.Context, issuer string, claims token.Claims) *authError {
+	jti := claims.ID()
+	if jti == "" {
+		return newAuthError(ReasonTokenInvalid, "The access token has no jti claim")
+	}
+	expiry := time.Now().Add(ReplayTTL)
+	if exp, ok := claims.Expiry(); ok && exp.After(expiry) {
+		expiry = exp
+	}
+	seen, err := ReplayStore.Seen(ctx, issuer+"#"+jti, expiry)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"issuer": issuer,
+			"err":    err,
+		}).Error("Unable to check the token for replays")
+		return newAuthError(ReasonReplayUnavailable, "The access token could not be checked for replays, retry later")
+	}
+	if seen {
+		return newAuthError(ReasonTokenReplayed, "The access token was already used")
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/revocation"
+)
+
+// Revocations is the denylist checked after a token's signature is verified
+var Revocations = revocation.NewList()
+
+// AdminRevocationsHandler lists the revocations (GET), adds one from the json body (POST)
+// or removes the one given by the type, value and issuer query parameters (DELETE)
+func (server *Server) AdminRevocationsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.WithField("remote_addr", r.RemoteAddr)
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, Revocations.Entries())
+	case "POST":
+		entry := revocation.Entry{}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&entry); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		entry, err := Revocations.Add(entry)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		logger.WithFields(log.Fields{
+			"type":   entry.Type,
+			"value":  entry.Value,
+			"issuer": entry.Issuer,
+			"reason": entry.Reason,
+		}).Info("Revocation added through the admin API")
+		writeJSON(w, http.StatusCreated, entry)
+	case "DELETE":
+		q := r.URL.Query()
+		if !Revocations.Remove(q.Get("type"), q.Get("value"), q.Get("issuer")) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "unknown revocation"})
+			return
+		}
+		logger.WithFields(log.Fields{
+			"type":   q.Get("type"),
+			"value":  q.Get("value"),
+			"issuer": q.Get("issuer"),
+		}).Info("Revocation removed through the admin API")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
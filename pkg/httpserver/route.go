@@ -0,0 +1,142 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/introspection"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/token"
+)
+
+// Route holds the settings that only apply to requests whose path contains the route's key in Routes
+type Route struct {
+	// RequiredScopes lists the scopes a token must carry to be allowed on the route
+	RequiredScopes []string `json:"required_scopes,omitempty"`
+	// Audiences lists the audiences accepted on the route, the token's aud claim must hold one of them
+	Audiences []string `json:"audiences,omitempty"`
+	// Shadow lists the stages run in shadow mode on the route: the requests they would deny are logged and counted in
+	// metrics, but are decided by the other stages. It measures the impact of new rules before enforcing them.
+	Shadow []string `json:"shadow,omitempty"`
+	// ErrorFormat selects the body of error responses: legacy, default, problem or template
+	ErrorFormat string `json:"error_format,omitempty"`
+	// ErrorTemplate is a text/template rendered with ErrorTemplateData when ErrorFormat is template
+	ErrorTemplate string `json:"error_template,omitempty"`
+	// ErrorContentType is the content type of rendered error templates, defaults to application/json
+	ErrorContentType string `json:"error_content_type,omitempty"`
+	// CORS overrides DefaultCORS for the route
+	CORS *CORS `json:"cors,omitempty"`
+	// TokenSources overrides DefaultTokenSources for the route. Sources are tried in order.
+	TokenSources []TokenSource `json:"token_sources,omitempty"`
+	// ReplayProtection rejects tokens whose jti claim was already seen, for one-time tokens. Tokens without jti are rejected.
+	ReplayProtection bool `json:"replay_protection,omitempty"`
+	// Introspection checks tokens that are not jwts against an RFC 7662 introspection endpoint
+	Introspection *introspection.Introspector `json:"introspection,omitempty"`
+
+	errorTemplate *template.Template
+}
+
+// UnmarshalJSON parses the route settings and checks that they are usable
+func (route *Route) UnmarshalJSON(data []byte) error {
+	type plain Route
+	if err := json.Unmarshal(data, (*plain)(route)); err != nil {
+		return err
+	}
+	return route.compile()
+}
+
+// compile validates the route settings and prepares the error template
+func (route *Route) compile() error {
+	switch route.ErrorFormat {
+	case "", ErrorFormatLegacy, ErrorFormatDefault, ErrorFormatProblem:
+	case ErrorFormatTemplate:
+		tmpl, err := template.New("error").Funcs(templateFuncs).Parse(route.ErrorTemplate)
+		if err != nil {
+			return fmt.Errorf("invalid error_template: %s", err)
+		}
+		route.errorTemplate = tmpl
+	default:
+		return fmt.Errorf("unknown error_format %q", route.ErrorFormat)
+	}
+	for _, stage := range route.Shadow {
+		if !canShadow(stage) {
+			return fmt.Errorf("stage %q can not run in shadow mode, expected one of %q", stage, ShadowStages)
+		}
+	}
+	return nil
+}
+
+// canShadow reports whether the stage is one of ShadowStages
+func canShadow(stage string) bool {
+	for _, s := range ShadowStages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// shadows reports whether the stage runs in shadow mode on the route
+func (route Route) shadows(stage string) bool {
+	for _, s := range route.Shadow {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// Routes maps a path (matched the same way as the keys of JwtIssuer) to its Route settings
+var Routes = map[string]Route{}
+
+// getRoute returns the settings for the request path. When several keys match, the longest one wins.
+func getRoute(r *http.Request) (string, Route) {
+	path := r.URL.Path
+	matched := ""
+	found := false
+	for routePath := range Routes {
+		if strings.Contains(path, routePath) && (!found || len(routePath) > len(matched)) {
+			matched = routePath
+			found = true
+		}
+	}
+	if !found {
+		return "", Route{}
+	}
+	return matched, Routes[matched]
+}
+
+// grantedScopes returns the scopes granted by the token's "scope" claim, space separated, or "scp" claim, a list
+func grantedScopes(claims token.Claims) []string {
+	granted := []string{}
+	for _, name := range []string{"scope", "scp"} {
+		switch v := claims[name].(type) {
+		case string:
+			granted = append(granted, strings.Fields(v)...)
+		case []interface{}:
+			for _, s := range v {
+				if str, ok := s.(string); ok {
+					granted = append(granted, str)
+				}
+			}
+		}
+	}
+	return granted
+}
+
+// missingScopes returns the scopes required by the route that are not granted by the token's "scope" or "scp" claim
+func missingScopes(route Route, claims token.Claims) []string {
+	granted := map[string]bool{}
+	for _, s := range grantedScopes(claims) {
+		granted[s] = true
+	}
+	missing := []string{}
+	for _, s := range route.RequiredScopes {
+		if !granted[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
@@ -1,19 +1,30 @@
 package httpserver
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	raven "github.com/getsentry/raven-go"
 	log "github.com/sirupsen/logrus"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/metrics"
 	"github.com/tomwganem/ambassador-auth-jwt/pkg/token"
-	"gopkg.in/square/go-jose.v2"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Error is returned in ErrorMsg
@@ -49,176 +60,230 @@ var (
 	BasicAuthRegex = regexp.MustCompile(`^Basic\ .*`)
 )
 
+var (
+	// ReadTimeout is the maximum duration for reading an entire request, including the body
+	ReadTimeout = 10 * time.Second
+	// ReadHeaderTimeout is the maximum duration for reading the request headers
+	ReadHeaderTimeout = 5 * time.Second
+	// WriteTimeout is the maximum duration before timing out writes of the response
+	WriteTimeout = 10 * time.Second
+	// IdleTimeout is the maximum duration to wait for the next request on a keep-alive connection
+	IdleTimeout = 120 * time.Second
+	// MaxHeaderBytes is the maximum size of the request headers
+	MaxHeaderBytes = 1 << 20
+)
+
 // Server needs to know about the Issuer url to verify tokens against
 type Server struct {
-	IssuerJwkSetMap map[string]jose.JSONWebKeySet
+	Keys *token.KeyStore
+	// Stages are the stages requests go through, DefaultStages when empty
+	Stages Pipeline
+
+	mu          sync.Mutex
+	httpServers []*http.Server
+	draining    bool
+	// cancel stops the retries of the issuers that could not be initialized
+	cancel context.CancelFunc
+}
+
+// listen serves the handler on the port until Shutdown is called, over TLS when tlsConfig is not nil
+func (server *Server) listen(port int, handler http.Handler, tlsConfig *tls.Config) error {
+	srv := &http.Server{
+		Addr:              fmt.Sprintf("0.0.0.0:%d", port),
+		Handler:           handler,
+		ReadTimeout:       ReadTimeout,
+		ReadHeaderTimeout: ReadHeaderTimeout,
+		WriteTimeout:      WriteTimeout,
+		IdleTimeout:       IdleTimeout,
+		MaxHeaderBytes:    MaxHeaderBytes,
+		TLSConfig:         tlsConfig,
+	}
+	server.mu.Lock()
+	if server.draining {
+		server.mu.Unlock()
+		return http.ErrServerClosed
+	}
+	server.httpServers = append(server.httpServers, srv)
+	server.mu.Unlock()
+	if tlsConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
 }
 
-// Start accepting requests and decoding Authorization headers
+// Start accepting requests and decoding Authorization headers, over TLS when TLSCertFile is set. It returns http.ErrServerClosed after Shutdown.
 func (server *Server) Start(port int) error {
-	// jwks, err := token.JwkSetGet(server.Issuer)
-	http.HandleFunc("/", server.DecodeHTTPHandler)
-	return http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", port), nil)
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.DecodeHTTPHandler)
+	return server.listen(port, mux, tlsConfig)
+}
+
+// StartAdmin serves the /metrics, /healthz and /readyz endpoints, and the /admin API when AdminToken is set, on a separate port
+func (server *Server) StartAdmin(port int) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", server.HealthzHandler)
+	mux.HandleFunc("/readyz", server.ReadyzHandler)
+	server.registerAdmin(mux)
+	return server.listen(port, mux, nil)
 }
 
-// DecodeHTTPHandler will try to extract the bearer token found in the Authorization header of each request and verify it
+// Shutdown stops accepting connections and waits for in-flight requests to complete, until the context is done.
+// The service reports itself as not ready from then on.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.draining = true
+	httpServers := server.httpServers
+	server.mu.Unlock()
+	if server.cancel != nil {
+		server.cancel()
+	}
+	var err error
+	for _, srv := range httpServers {
+		if shutdownErr := srv.Shutdown(ctx); shutdownErr != nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
+
+// DecodeHTTPHandler will try to extract the bearer token found in the route's token sources (the Authorization header by default) of each request and verify it
 func (server *Server) DecodeHTTPHandler(w http.ResponseWriter, r *http.Request) {
-	q, _ := url.ParseQuery(r.URL.RawQuery)
-	successFields := log.Fields{
-		"remote_addr": r.RemoteAddr,
-		"host":        r.Host,
-		"method":      r.Method,
-		"path":        r.URL.Path,
-		"query":       q,
-		"user_agent":  r.UserAgent(),
-		"status":      "200",
+	req, allowed := server.authorize(w, r)
+	if !allowed {
+		return
+	}
+	for name, values := range req.UpstreamHeader {
+		w.Header()[name] = values
 	}
-	errorFields := log.Fields{
+}
+
+// authorize runs the request through the pipeline stages and reports whether it is allowed, writing the error response
+// when it is not. The response headers set by the stages are written either way.
+func (server *Server) authorize(w http.ResponseWriter, r *http.Request) (*AuthRequest, bool) {
+	q, _ := url.ParseQuery(r.URL.RawQuery)
+	fields := log.Fields{
 		"remote_addr": r.RemoteAddr,
 		"host":        r.Host,
 		"method":      r.Method,
 		"path":        r.URL.Path,
 		"query":       q,
 		"user_agent":  r.UserAgent(),
-		"status":      "401",
-	}
-	debugFields := log.Fields{
-		"method": r.Method,
-		"path":   r.URL.Path,
-		"query":  q,
 	}
-	successLogger := log.WithFields(successFields)
-	errorLogger := log.WithFields(errorFields)
-	debugLogger := log.WithFields(debugFields)
 
-	unauthorizedOld := map[string]string{"code": "unauthorized", "message": "You are not authorized to perform the requested action"}
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracing.Tracer().Start(ctx, "DecodeHTTPHandler", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(semconv.HTTPServerAttributesFromHTTPRequest("ambassador-auth-jwt", r.URL.Path, r)...))
+	defer span.End()
 
-	unauthorizedNew := ErrorMsg{
-		StatusCode: 401,
-		Errors: []Error{
-			{
-				Code:    "unauthorized",
-				Message: "You are not authorized to perform the requested action",
-			},
-		},
+	_, lookupSpan := tracing.Tracer().Start(ctx, "route lookup")
+	routePath, route := getRoute(r)
+	issuerFound, issuer := getJwtIssuer(r)
+	if !issuerFound {
+		issuer = ""
 	}
+	lookupSpan.SetAttributes(attribute.String("route", routePath), attribute.String("jwt.issuer", issuer))
+	lookupSpan.End()
 
-	matchedPath := NewErrorMessageRegex.Match([]byte(r.URL.Path))
-	var error []byte
-	if matchedPath {
-		error, _ = json.Marshal(unauthorizedNew)
-	} else {
-		error, _ = json.Marshal(unauthorizedOld)
+	req := &AuthRequest{
+		Request:        r,
+		RoutePath:      routePath,
+		Route:          route,
+		Issuer:         issuer,
+		ResponseHeader: w.Header(),
+		UpstreamHeader: http.Header{},
+		Fields:         log.Fields{},
+		Reason:         "token_valid",
+		Explain:        explainRequested(r),
 	}
+	start := time.Now()
+	e := server.stages().run(ctx, req)
 
-	enableCors(&w)
-	// Enabled PREFLIGHT calls
-	if r.Method == "OPTIONS" {
-		successLogger.Info("CORS Request OK")
-		return
+	decision := metrics.Allow
+	if e != nil {
+		decision = metrics.Deny
 	}
-
-	auth := r.Header.Get("Authorization")
-	query := r.URL.Query()
-	t := query["token"]
-	bt := query["bearer_token"]
-	basicAuthAllowed, msg := basicAuthPassCheck(r, debugLogger)
-	matchedAuth := BasicAuthRegex.Match([]byte(auth))
-	// Allows basic auth credentials in the Authorization header to be passed through
-	if matchedAuth && basicAuthAllowed {
-		successLogger.Info(msg)
-		return
+	metrics.ObserveDecision(decision, req.Reason, req.Issuer, routePath, time.Since(start))
+	span.SetAttributes(attribute.String("auth.decision", decision), attribute.String("auth.reason", req.Reason))
+	for _, step := range req.Trace {
+		span.AddEvent("stage", trace.WithAttributes(
+			attribute.String("stage.name", step.Stage),
+			attribute.String("stage.result", step.Result),
+			attribute.String("stage.reason", step.Reason),
+		))
 	}
-	// The following checks for tokens passed as a query parameter
-	if auth == "" && !basicAuthAllowed {
-		if len(t) < 1 || t[0] == "" {
-			if len(bt) < 1 || bt[0] == "" {
-				errorLogger.Warn("Unable to retrieve JWToken from Authorization header or query parameter. " + msg)
-				http.Error(w, string(error), 401)
-				return
-			}
-			auth = bt[0]
-		} else {
-			auth = t[0]
+	req.debug().WithField("trace", req.Trace).Debug("Decision trace")
+	for _, step := range req.Trace {
+		if step.Result == StepShadowDeny {
+			metrics.ObserveShadowDenial(step.Stage, step.Reason, req.Issuer, routePath)
+			log.WithFields(fields).WithFields(log.Fields{
+				"stage":  step.Stage,
+				"reason": step.Reason,
+			}).Warn("Stage in shadow mode would deny the request: " + step.Detail)
 		}
-
-	} else if auth == "" && basicAuthAllowed {
-		log.WithFields(successFields).Info(msg)
-		return
-	}
-
-	claims := make(map[string]interface{})
-	auth = strings.Replace(auth, "Bearer ", "", 1)
-	found,issuer := getJwtIssuer(r)
-	if !found {
-		errorLogger.Error("Could not find jwt issuer for path " + r.URL.Path)
-		http.Error(w, string(error), 401)
-		return
-	}
-	claims, jwkset, err := token.Decode(auth, server.IssuerJwkSetMap[issuer], issuer)
-	server.IssuerJwkSetMap[issuer] = jwkset
-	if err != nil {
-		errorLogger.Error(err.Error())
-		http.Error(w, string(error), 401)
-		return
 	}
-	exp := time.Now()
-	if JwtCheckExp {
-		// Checks to see if the there is an "exp" field
-		if _, ok := claims["exp"]; ok != true {
-			// Checks to see if there is an "expires_at" field. Note: "expires_at" doesn't follow the RFC and shouldn't be a field in most JWTokens. It's the same as "exp", except it's in RFC3339.
-			if _, ok := claims["expires_at"]; ok != true {
-				errorLogger.Error(err.Error())
-				http.Error(w, string(error), 401)
-				return
-			}
-			exp, err = time.Parse(time.RFC3339, claims["expires_at"].(string))
-			if err != nil {
-				raven.CaptureError(err, nil)
-				errorLogger.Error(err.Error())
-				http.Error(w, string(error), 500)
-			}
-		} else {
-			exp = time.Unix(int64(claims["exp"].(float64)), 0)
+	if req.Explain {
+		explanation := req.explanation(decision)
+		if data, err := json.Marshal(explanation); err == nil {
+			w.Header().Set(ExplanationHeader, string(data))
 		}
+		log.WithFields(fields).WithField("explanation", explanation).Info("Decision explained")
+	}
 
-		now := time.Now()
-
-		if exp.Before(now) {
-			errorLogger.Error("Token is expired")
-			http.Error(w, string(error), 401)
-			return
+	if e != nil {
+		span.SetStatus(codes.Error, req.Reason)
+		fields["status"] = strconv.Itoa(e.Status)
+		logger := log.WithFields(fields).WithFields(req.Fields)
+		if e.Reason == ReasonTokenMissing {
+			logger.Warn(e.logMessage())
+		} else {
+			logger.Error(e.logMessage())
 		}
+		writeError(w, r, e)
+		return req, false
 	}
-	marshaledClaims, err := json.Marshal(claims)
-	successFields["claims"] = claims
-	log.WithFields(successFields).Info("Authentication Success")
-	w.Header().Set(JwtOutboundHeader, string(marshaledClaims))
+	fields["status"] = "200"
+	if req.Claims != nil {
+		fields["claims"] = req.Claims
+	}
+	log.WithFields(fields).WithFields(req.Fields).WithField("reason", req.Reason).Info("Authentication Success")
+	return req, true
 }
 
-// NewServer creates a new Server object with the jwkset retrieved from the issuer
+// NewServer creates a new Server object with the jwkset retrieved from each issuer, or from the cache when an issuer can not be reached.
+// Issuers are initialized concurrently. Those that fail or were loaded from the cache are retried in the background until Shutdown, and their routes are
+// rejected with ReasonIssuerUnavailable meanwhile.
 func NewServer(issuers []string) *Server {
-	jwks, err := token.JwkSetGetMap(issuers)
-	if err != nil {
-		raven.CaptureErrorAndWait(err, nil)
-		log.WithFields(log.Fields{
-			"issuerJwkSetMap": jwks,
-			"err":    err,
-		}).Fatal("Unable to retrieve keyset")
+	ctx, cancel := context.WithCancel(context.Background())
+	server := &Server{
+		Keys:   token.NewKeyStore(),
+		cancel: cancel,
 	}
-
-	return &Server{
-		IssuerJwkSetMap: jwks,
+	var wg sync.WaitGroup
+	for _, issuer := range issuers {
+		wg.Add(1)
+		go func(issuer string) {
+			defer wg.Done()
+			source, err := server.Keys.Init(ctx, issuer)
+			if err != nil {
+				raven.CaptureError(err, nil)
+				log.WithFields(log.Fields{
+					"issuer": issuer,
+					"err":    err,
+				}).Error("Unable to retrieve keyset, retrying in the background")
+			}
+			// Keysets loaded from the cache may be stale, they are replaced as soon as the issuer can be reached
+			if err != nil || source == token.SourceCache {
+				go server.retryIssuer(ctx, issuer)
+			}
+		}(issuer)
 	}
-}
-
-// enableCors sets some hardcoded headers for OPTIONS requests. We return all OPTIONS requests with a 200.
-func enableCors(w *http.ResponseWriter) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-	(*w).Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, PUT, OPTIONS")
-	(*w).Header().Set("Access-Control-Allow-Headers", "authorization")
-	(*w).Header().Set("Access-Control-Max-Age", "1728000")
-	(*w).Header().Set("Access-Control-Expose-Headers", "")
+	wg.Wait()
+	return server
 }
 
 // basicAuthPassCheck returns a boolean. It will return true if:
@@ -270,12 +335,12 @@ func basicAuthHeaderCheck(header string, r *http.Request, debugLogger *log.Entry
 	return false, "Basic Auth Not Allowed"
 }
 
-func getJwtIssuer(r *http.Request) (bool,string) {
-	 path := r.URL.Path
-	 for jwt_path, issuer := range JwtIssuer {
-		 if (strings.Contains(path, jwt_path)) {
-			 return true,issuer
-		 }
-	 }
-	 return false,"Path not found in jwt keys"
+func getJwtIssuer(r *http.Request) (bool, string) {
+	path := r.URL.Path
+	for jwt_path, issuer := range JwtIssuer {
+		if strings.Contains(path, jwt_path) {
+			return true, issuer
+		}
+	}
+	return false, "Path not found in jwt keys"
 }
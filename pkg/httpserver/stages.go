@@ -0,0 +1,264 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	log "github.com/sirupsen/logrus"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/token"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Names of the built-in stages, in the order they run
+const (
+	StageCORS           = "cors"
+	StageBasicAuth      = "basic_auth"
+	StageExtractToken   = "extract_token"
+	StageIssuer         = "issuer"
+	StageVerify         = "verify"
+	StageExpiration     = "expiration"
+	StageRevocation     = "revocation"
+	StageAudience       = "audience"
+	StageScopes         = "scopes"
+	StageReplay         = "replay"
+	StageOutboundHeader = "outbound_header"
+)
+
+// ShadowStages lists the stages routes can run in shadow mode: the built-in stages denying valid tokens. The stages
+// finding and verifying the token, and those that never deny, can not. Builds registering their own stages add the
+// names of those that can run in shadow mode before Routes is parsed.
+var ShadowStages = []string{StageExpiration, StageRevocation, StageAudience, StageScopes, StageReplay}
+
+// DefaultStages returns the built-in stages. Custom stages can be added with Pipeline.Insert and set in Server.Stages.
+func (server *Server) DefaultStages() Pipeline {
+	return Pipeline{
+		StageFunc(StageCORS, corsStage),
+		StageFunc(StageBasicAuth, basicAuthStage),
+		StageFunc(StageExtractToken, extractTokenStage),
+		StageFunc(StageIssuer, issuerStage),
+		StageFunc(StageVerify, server.verifyStage),
+		StageFunc(StageExpiration, expirationStage),
+		StageFunc(StageRevocation, revocationStage),
+		StageFunc(StageAudience, audienceStage),
+		StageFunc(StageScopes, scopesStage),
+		StageFunc(StageReplay, replayStage),
+		StageFunc(StageOutboundHeader, outboundHeaderStage),
+	}
+}
+
+// stages returns Server.Stages, or the built-in stages when it is empty
+func (server *Server) stages() Pipeline {
+	if len(server.Stages) > 0 {
+		return server.Stages
+	}
+	return server.DefaultStages()
+}
+
+// corsStage sets the route's CORS headers and answers preflight requests without checking for a token
+func corsStage(ctx context.Context, req *AuthRequest) (Verdict, error) {
+	cors := corsFor(req.Route)
+	cors.apply(req.ResponseHeader, req.Request)
+	req.Note("origin", req.Request.Header.Get("Origin"))
+	// Enabled PREFLIGHT calls
+	if cors.skipsAuth(req.Request) {
+		req.Reason = "cors_preflight"
+		return Allow, nil
+	}
+	return Continue, nil
+}
+
+// basicAuthStage lets basic auth credentials through when allowed, unless a bearer token is provided in the Authorization header
+func basicAuthStage(ctx context.Context, req *AuthRequest) (Verdict, error) {
+	auth := req.Request.Header.Get("Authorization")
+	basicAuthAllowed, msg := basicAuthPassCheck(req.Request, req.debug())
+	req.Note("basic_auth", msg)
+	if basicAuthAllowed && (auth == "" || BasicAuthRegex.Match([]byte(auth))) {
+		req.Reason = "basic_auth"
+		return Allow, nil
+	}
+	return Continue, nil
+}
+
+// extractTokenStage looks for the token in the route's token sources
+func extractTokenStage(ctx context.Context, req *AuthRequest) (Verdict, error) {
+	_, extractSpan := tracing.Tracer().Start(ctx, "extract token")
+	sources := tokenSourcesFor(req.Route)
+	raw, source, found := extractToken(req.Request, sources)
+	extractSpan.SetAttributes(attribute.Bool("token.found", found), attribute.String("token.source", source.String()))
+	extractSpan.End()
+	if !found {
+		req.Note("sources", describeSources(sources))
+		return Continue, newAuthError(ReasonTokenMissing, "The access token is missing").
+			withDetail(fmt.Sprintf("Unable to retrieve JWToken from %s", describeSources(sources)))
+	}
+	req.debug().Trace("Found token in " + source.String())
+	req.Note("source", source.String())
+	req.Token, req.TokenSource = raw, source
+	return Continue, nil
+}
+
+// issuerStage rejects paths without an issuer, unless their route has an introspection endpoint
+func issuerStage(ctx context.Context, req *AuthRequest) (Verdict, error) {
+	req.Note("route", req.RoutePath)
+	req.Note("issuer", req.Issuer)
+	if req.Route.Introspection != nil {
+		req.Note("introspection", req.Route.Introspection.URL)
+	}
+	if req.Issuer == "" && req.Route.Introspection == nil {
+		return Continue, newAuthError(ReasonIssuerNotFound, "No issuer is configured for this path").
+			withDetail("Could not find jwt issuer for path " + req.Request.URL.Path)
+	}
+	return Continue, nil
+}
+
+// verifyStage decodes the token with the issuer's keyset. Tokens that are not jwts, or paths without an issuer, fall back
+// to the route's introspection endpoint. The claims are copied, the verified ones are cached and shared by requests.
+func (server *Server) verifyStage(ctx context.Context, req *AuthRequest) (Verdict, error) {
+	err := token.ErrMalformed
+	if req.Issuer != "" {
+		var verified token.Verified
+		verified, err = token.DecodeVerified(ctx, req.Token, server.Keys, req.Issuer)
+		verificationErr := &token.VerificationError{}
+		if errors.As(err, &verificationErr) {
+			verified.KeyID, verified.Algorithm = verificationErr.KeyID, verificationErr.Algorithm
+		}
+		if verified.KeyID != "" || verified.Algorithm != "" {
+			req.Note("kid", verified.KeyID)
+			req.Note("alg", verified.Algorithm)
+		}
+		req.Claims, req.KeyID = verified.Claims.Copy(), verified.KeyID
+	}
+	if errors.Is(err, token.ErrMalformed) && req.Route.Introspection != nil {
+		if req.Issuer == "" {
+			req.Issuer = req.Route.Introspection.URL
+		}
+		req.Note("introspected", "true")
+		req.Introspected = true
+		var claims token.Claims
+		claims, err = req.Route.Introspection.Introspect(ctx, req.Token)
+		req.Claims = claims.Copy()
+	}
+	if err != nil {
+		return Continue, decodeError(err).withDetail(err.Error())
+	}
+	return Continue, nil
+}
+
+// expirationStage rejects expired tokens, and tokens without expiration, when JwtCheckExp is set. Introspected tokens
+// without expiration are allowed, the introspection endpoint reported them as active.
+func expirationStage(ctx context.Context, req *AuthRequest) (Verdict, error) {
+	if !JwtCheckExp {
+		req.Note("check_exp", "false")
+		return Continue, nil
+	}
+	// Checks to see if the there is an "exp" field
+	exp, ok := req.Claims.Expiry()
+	if !ok && req.Introspected {
+		req.Note("exp", "none")
+		return Continue, nil
+	}
+	if !ok {
+		// Checks to see if there is an "expires_at" field. Note: "expires_at" doesn't follow the RFC and shouldn't be a field in most JWTokens. It's the same as "exp", except it's in RFC3339.
+		if _, ok := req.Claims["expires_at"]; ok != true {
+			return Continue, newAuthError(ReasonTokenInvalid, "The access token has no expiration").withDetail("Token has no expiration")
+		}
+		var err error
+		exp, err = time.Parse(time.RFC3339, req.Claims.String("expires_at"))
+		if err != nil {
+			raven.CaptureError(err, nil)
+			return Continue, newAuthError(ReasonTokenInvalid, "The access token expiration could not be read").withDetail(err.Error())
+		}
+	}
+	now := time.Now()
+	req.Note("exp", exp.UTC().Format(time.RFC3339))
+	req.Note("now", now.UTC().Format(time.RFC3339))
+	if exp.Before(now) {
+		return Continue, newAuthError(ReasonTokenExpired, "The access token expired").withDetail("Token is expired")
+	}
+	return Continue, nil
+}
+
+// revocationStage rejects tokens matching an entry of Revocations, and forgets their cached verification
+func revocationStage(ctx context.Context, req *AuthRequest) (Verdict, error) {
+	entry, revoked := Revocations.Revoked(req.Issuer, req.KeyID, req.Claims)
+	if !revoked {
+		return Continue, nil
+	}
+	req.Note("revoked_by", entry.Type+" "+entry.Value)
+	req.Fields["revocation_type"] = entry.Type
+	req.Fields["revocation_reason"] = entry.Reason
+	token.Results.Forget(req.Issuer, req.Token)
+	return Continue, newAuthError(ReasonTokenRevoked, "The access token was revoked").withDetail("Token is revoked")
+}
+
+// audienceStage rejects tokens whose aud claim does not hold one of the route's audiences
+func audienceStage(ctx context.Context, req *AuthRequest) (Verdict, error) {
+	if len(req.Route.Audiences) == 0 {
+		return Continue, nil
+	}
+	audience := req.Claims.Audience()
+	req.Note("required", strings.Join(req.Route.Audiences, " "))
+	req.Note("aud", strings.Join(audience, " "))
+	for _, aud := range audience {
+		for _, accepted := range req.Route.Audiences {
+			if aud == accepted {
+				return Continue, nil
+			}
+		}
+	}
+	return Continue, newAuthError(ReasonInvalidAudience, "The access token is not intended for this service").
+		withDetail(fmt.Sprintf("Token audience %q is not one of %q", audience, req.Route.Audiences))
+}
+
+// scopesStage rejects tokens that do not grant the route's required scopes
+func scopesStage(ctx context.Context, req *AuthRequest) (Verdict, error) {
+	if len(req.Route.RequiredScopes) == 0 {
+		return Continue, nil
+	}
+	req.Note("required", strings.Join(req.Route.RequiredScopes, " "))
+	req.Note("granted", strings.Join(grantedScopes(req.Claims), " "))
+	if missing := missingScopes(req.Route, req.Claims); len(missing) > 0 {
+		return Continue, forbidden("The access token does not grant the required scopes", req.Route.RequiredScopes).
+			withDetail("Token is missing required scopes: " + strings.Join(missing, " "))
+	}
+	return Continue, nil
+}
+
+// replayStage rejects tokens already used on routes with replay protection
+func replayStage(ctx context.Context, req *AuthRequest) (Verdict, error) {
+	if !req.Route.ReplayProtection {
+		return Continue, nil
+	}
+	req.Note("jti", req.Claims.ID())
+	if e := checkReplay(ctx, req.Issuer, req.Claims); e != nil {
+		return Continue, e
+	}
+	return Continue, nil
+}
+
+// outboundHeaderStage passes the claims upstream in JwtOutboundHeader
+func outboundHeaderStage(ctx context.Context, req *AuthRequest) (Verdict, error) {
+	marshaledClaims, err := json.Marshal(req.Claims)
+	if err != nil {
+		return Continue, err
+	}
+	req.UpstreamHeader.Set(JwtOutboundHeader, string(marshaledClaims))
+	return Continue, nil
+}
+
+// debug returns the request's debug logger
+func (req *AuthRequest) debug() *log.Entry {
+	if req.debugLogger == nil {
+		req.debugLogger = log.WithFields(log.Fields{
+			"method": req.Request.Method,
+			"path":   req.Request.URL.Path,
+		})
+	}
+	return req.debugLogger
+}
@@ -0,0 +1,181 @@
+package httpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// TLSCertFile is the PEM certificate served by the auth listener. TLS is disabled when it is empty.
+	TLSCertFile = ""
+	// TLSKeyFile is the PEM private key of TLSCertFile
+	TLSKeyFile = ""
+	// TLSClientCAFile is a PEM bundle of CAs. When set, clients must present a certificate signed by one of them.
+	TLSClientCAFile = ""
+	// TLSMinVersion is the minimum TLS version accepted
+	TLSMinVersion uint16 = tls.VersionTLS12
+	// TLSCipherSuites restricts the cipher suites used with TLS 1.2 and below. Go's defaults are used when empty.
+	TLSCipherSuites []uint16
+)
+
+// certReloadInterval is how often the certificate files are checked for changes
+var certReloadInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion converts a version such as "1.2" to its tls constant
+func ParseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(version), "tls")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", version)
+	}
+	return v, nil
+}
+
+// tlsVersionName returns the version as accepted by ParseTLSVersion
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// ParseCipherSuites converts a comma separated list of cipher suite names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, to their ids.
+// Insecure cipher suites are rejected.
+func ParseCipherSuites(names string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	ids := []uint16{}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// certReloader serves the certificate in certFile and keyFile, loading them again when they change on disk
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	lastStat time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// lastModified returns the latest modification time of the certificate and key files
+func (c *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload loads the certificate from disk. It must be called with mu held, or before the reloader is shared.
+func (c *certReloader) reload() error {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. The files are checked at most every certReloadInterval,
+// and the previous certificate is kept when the new one can not be loaded.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.lastStat) < certReloadInterval {
+		return c.cert, nil
+	}
+	c.lastStat = time.Now()
+	modTime, err := c.lastModified()
+	if err != nil || modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+	if err := c.reload(); err != nil {
+		log.WithFields(log.Fields{
+			"cert_file": c.certFile,
+			"err":       err,
+		}).Error("Unable to reload TLS certificate, keeping the previous one")
+		return c.cert, nil
+	}
+	log.WithField("cert_file", c.certFile).Info("Reloaded TLS certificate")
+	return c.cert, nil
+}
+
+// newTLSConfig returns the TLS settings of the auth listener, or nil when TLS is disabled
+func newTLSConfig() (*tls.Config, error) {
+	if TLSCertFile == "" {
+		return nil, nil
+	}
+	if TLSKeyFile == "" {
+		return nil, errors.New("TLS_KEY_FILE is required with TLS_CERT_FILE")
+	}
+	reloader, err := newCertReloader(TLSCertFile, TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     TLSMinVersion,
+		CipherSuites:   TLSCipherSuites,
+	}
+	if TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", TLSClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
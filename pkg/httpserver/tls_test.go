@@ -0,0 +1,157 @@
+package httpserver
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and its key, signed by parent (or self-signed when parent is nil)
+type testCert struct {
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write saves the certificate and key as PEM files in dir
+func (c *testCert) write(t *testing.T, dir string, name string) (string, string) {
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(c.key)})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil, true)
+	caFile, _ := ca.write(t, dir, "ca")
+	serverCert := newTestCert(t, "server", ca, false)
+	TLSCertFile, TLSKeyFile = serverCert.write(t, dir, "server")
+	TLSClientCAFile = caFile
+	defer func() { TLSCertFile, TLSKeyFile, TLSClientCAFile = "", "", "" }()
+	defer func(interval time.Duration) { certReloadInterval = interval }(certReloadInterval)
+	certReloadInterval = 0
+
+	server := newTestServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	go server.Start(port)
+	defer server.Shutdown(nil)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+	}
+	url := fmt.Sprintf("https://127.0.0.1:%d/api", port)
+	clientCert := newTestCert(t, "client", ca, false).tlsCertificate()
+
+	var resp *http.Response
+	for i := 0; i < 100; i++ {
+		if resp, err = client(clientCert).Get(url); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 401 || resp.TLS.PeerCertificates[0].Subject.CommonName != "server" {
+		t.Errorf("expected a 401 over TLS from the server certificate, got %d", resp.StatusCode)
+	}
+
+	if _, err := client().Get(url); err == nil {
+		t.Error("expected the connection to fail without a client certificate")
+	}
+	untrusted := newTestCert(t, "untrusted", nil, false).tlsCertificate()
+	if _, err := client(untrusted).Get(url); err == nil {
+		t.Error("expected the connection to fail with a client certificate from another CA")
+	}
+
+	// Replace the certificate on disk, it is picked up by the next handshake
+	newTestCert(t, "rotated", ca, false).write(t, dir, "server")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(TLSCertFile, future, future)
+	resp, err = client(clientCert).Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.TLS.PeerCertificates[0].Subject.CommonName; got != "rotated" {
+		t.Errorf("expected the rotated certificate to be served, got %s", got)
+	}
+}
+
+func TestParseTLSSettings(t *testing.T) {
+	if v, err := ParseTLSVersion("1.3"); err != nil || v != tls.VersionTLS13 {
+		t.Errorf("expected TLS 1.3, got %x, %v", v, err)
+	}
+	if _, err := ParseTLSVersion("2.0"); err == nil {
+		t.Error("expected unknown version to be rejected")
+	}
+	if ids, err := ParseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"); err != nil || len(ids) != 2 {
+		t.Errorf("expected 2 cipher suites, got %v, %v", ids, err)
+	}
+	if _, err := ParseCipherSuites("TLS_RSA_WITH_RC4_128_SHA"); err == nil {
+		t.Error("expected insecure cipher suite to be rejected")
+	}
+}
@@ -0,0 +1,193 @@
+// Package introspection checks opaque access tokens against an OAuth 2.0 token introspection endpoint (RFC 7662)
+package introspection
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/token"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// ErrInactive is returned when the endpoint reports the token as not active
+	ErrInactive = errors.New("Token is not active")
+	// ErrUnavailable is returned when the endpoint can not be reached or its response can not be read
+	ErrUnavailable = errors.New("Token introspection failed")
+)
+
+var (
+	// Timeout bounds the requests to introspection endpoints
+	Timeout = 10 * time.Second
+	// MaxCacheSize is the maximum number of active responses cached by an Introspector
+	MaxCacheSize = 10000
+)
+
+// Introspector asks an introspection endpoint whether tokens are active, authenticating with client credentials.
+// Active responses with an exp member are cached until the token expires, in an LRU cache of MaxCacheSize responses.
+// It is safe for concurrent use.
+type Introspector struct {
+	// URL of the introspection endpoint
+	URL string `json:"url"`
+	// ClientID and ClientSecret authenticate the requests with HTTP basic authentication
+	ClientID     string `json:"client_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+type cachedResponse struct {
+	key    string
+	claims token.Claims
+	expiry time.Time
+}
+
+// UnmarshalJSON parses the settings and checks the endpoint url
+func (i *Introspector) UnmarshalJSON(data []byte) error {
+	type plain Introspector
+	if err := json.Unmarshal(data, (*plain)(i)); err != nil {
+		return err
+	}
+	u, err := url.Parse(i.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid introspection url %q", i.URL)
+	}
+	return nil
+}
+
+// MarshalJSON hides the client secret
+func (i *Introspector) MarshalJSON() ([]byte, error) {
+	secret := ""
+	if i.ClientSecret != "" {
+		secret = "REDACTED"
+	}
+	return json.Marshal(map[string]string{
+		"url":           i.URL,
+		"client_id":     i.ClientID,
+		"client_secret": secret,
+	})
+}
+
+// Introspect returns the claims of the introspection response of an active token, without the active member.
+// It returns ErrInactive when the token is not active and ErrUnavailable when the endpoint fails.
+func (i *Introspector) Introspect(ctx context.Context, raw string) (token.Claims, error) {
+	sum := sha256.Sum256([]byte(raw))
+	key := hex.EncodeToString(sum[:])
+	if claims, ok := i.cached(key); ok {
+		return claims, nil
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "token introspection", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("introspection.url", i.URL)))
+	defer span.End()
+	claims, err := i.request(ctx, raw)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	active, _ := claims["active"].(bool)
+	if !active {
+		return nil, ErrInactive
+	}
+	delete(claims, "active")
+	if exp, ok := claims.Expiry(); ok {
+		i.store(key, claims, exp)
+	}
+	return claims, nil
+}
+
+// request posts the token to the endpoint and decodes the response
+func (i *Introspector) request(ctx context.Context, raw string) (token.Claims, error) {
+	form := url.Values{"token": {raw}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, "POST", i.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(i.ClientID), url.QueryEscape(i.ClientSecret))
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := (&http.Client{Timeout: Timeout}).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: unexpected status %s", ErrUnavailable, resp.Status)
+	}
+	claims := token.Claims{}
+	decoder := json.NewDecoder(io.LimitReader(resp.Body, 1<<20))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	return claims, nil
+}
+
+func (i *Introspector) clock() time.Time {
+	if i.now != nil {
+		return i.now()
+	}
+	return time.Now()
+}
+
+// cached returns the claims of a cached response that has not expired
+func (i *Introspector) cached(key string) (token.Claims, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	element, ok := i.entries[key]
+	if !ok {
+		return nil, false
+	}
+	response := element.Value.(*cachedResponse)
+	if !response.expiry.After(i.clock()) {
+		i.order.Remove(element)
+		delete(i.entries, key)
+		return nil, false
+	}
+	i.order.MoveToFront(element)
+	return response.claims, true
+}
+
+// store caches the claims until expiry, evicting the least recently used responses when the cache is full
+func (i *Introspector) store(key string, claims token.Claims, expiry time.Time) {
+	if MaxCacheSize <= 0 || !expiry.After(i.clock()) {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.entries == nil {
+		i.order = list.New()
+		i.entries = map[string]*list.Element{}
+	}
+	if element, ok := i.entries[key]; ok {
+		i.order.Remove(element)
+	}
+	i.entries[key] = i.order.PushFront(&cachedResponse{key: key, claims: claims, expiry: expiry})
+	for i.order.Len() > MaxCacheSize {
+		oldest := i.order.Back()
+		i.order.Remove(oldest)
+		delete(i.entries, oldest.Value.(*cachedResponse).key)
+	}
+}
@@ -0,0 +1,86 @@
+package introspection
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIntrospect(t *testing.T) {
+	requests := 0
+	exp := time.Now().Add(time.Hour).Unix()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if id, secret, _ := r.BasicAuth(); id != "client" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		switch token := r.PostForm.Get("token"); {
+		case strings.HasPrefix(token, "active"):
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "sub": "partner", "scope": "read", "exp": exp})
+		case token == "error":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(`{"active": false}`))
+		}
+	}))
+	defer server.Close()
+
+	introspector := &Introspector{}
+	if err := json.Unmarshal([]byte(`{"url": "`+server.URL+`", "client_id": "client", "client_secret": "s3cret"}`), introspector); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	claims, err := introspector.Introspect(ctx, "active")
+	if err != nil || claims["sub"] != "partner" || claims["active"] != nil {
+		t.Fatalf("expected the claims of the active token, got %v, %v", claims, err)
+	}
+	introspector.Introspect(ctx, "active")
+	if requests != 1 {
+		t.Errorf("expected the active response to be cached, got %d requests", requests)
+	}
+	now := time.Now().Add(2 * time.Hour)
+	introspector.now = func() time.Time { return now }
+	introspector.Introspect(ctx, "active")
+	if requests != 2 {
+		t.Errorf("expected the cached response to expire with the token, got %d requests", requests)
+	}
+
+	// The least recently used response is evicted when the cache is full
+	defer func(size int) { MaxCacheSize = size }(MaxCacheSize)
+	MaxCacheSize = 2
+	introspector.now = nil
+	introspector.Introspect(ctx, "active-a")
+	introspector.Introspect(ctx, "active-b")
+	introspector.Introspect(ctx, "active-a")
+	introspector.Introspect(ctx, "active")
+	if requests != 5 {
+		t.Fatalf("expected the cached responses to be used, got %d requests", requests)
+	}
+	introspector.Introspect(ctx, "active-b")
+	if requests != 6 {
+		t.Errorf("expected the least recently used response to be evicted, got %d requests", requests)
+	}
+
+	if _, err := introspector.Introspect(ctx, "revoked"); !errors.Is(err, ErrInactive) {
+		t.Errorf("expected ErrInactive, got %v", err)
+	}
+	if _, err := introspector.Introspect(ctx, "error"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected ErrUnavailable, got %v", err)
+	}
+
+	body, _ := json.Marshal(introspector)
+	if strings.Contains(string(body), "s3cret") {
+		t.Errorf("expected the client secret to be redacted, got %s", body)
+	}
+	if err := json.Unmarshal([]byte(`{"url": "not a url"}`), &Introspector{}); err == nil {
+		t.Error("expected an invalid url to be rejected")
+	}
+}
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ambassador_auth_jwt"
+
+// Decision labels
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+var (
+	// Decisions counts the requests allowed or denied, by reason code, issuer and route
+	Decisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decisions_total",
+		Help:      "Number of auth decisions by decision, reason, issuer and route.",
+	}, []string{"decision", "reason", "issuer", "route"})
+	// HandlerDuration observes the time taken by DecodeHTTPHandler
+	HandlerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "handler_duration_seconds",
+		Help:      "Time taken to decide whether a request is allowed.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+	}, []string{"decision"})
+	// DecodeDuration observes the time taken by token.Decode, including keyset refreshes
+	DecodeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "token_decode_duration_seconds",
+		Help:      "Time taken to parse and verify a token.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+	}, []string{"issuer"})
+	// JwksFetches counts the keyset fetches by issuer and result (success or failure)
+	JwksFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jwks_fetches_total",
+		Help:      "Number of JWK Set fetches by issuer and result.",
+	}, []string{"issuer", "result"})
+	// JwksKeys is the number of keys in the last keyset fetched for each issuer
+	JwksKeys = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "jwks_keys",
+		Help:      "Number of keys in the issuer's JWK Set.",
+	}, []string{"issuer"})
+
+	// VerificationCache counts the lookups of verified tokens in the result cache, by result (hit or miss)
+	VerificationCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "verification_cache_lookups_total",
+		Help:      "Number of lookups of verified tokens in the result cache by result.",
+	}, []string{"result"})
+
+	// ShadowDenials counts the requests that stages in shadow mode would have denied, by stage, reason code, issuer and route
+	ShadowDenials = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "shadow_denials_total",
+		Help:      "Number of requests stages in shadow mode would have denied by stage, reason, issuer and route.",
+	}, []string{"stage", "reason", "issuer", "route"})
+
+	lastRefresh = &refreshCollector{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "jwks_seconds_since_last_refresh"),
+			"Seconds since the issuer's JWK Set was last fetched successfully.",
+			[]string{"issuer"}, nil,
+		),
+		last: map[string]time.Time{},
+	}
+)
+
+func init() {
+	prometheus.MustRegister(Decisions, HandlerDuration, DecodeDuration, JwksFetches, JwksKeys, VerificationCache, ShadowDenials, lastRefresh)
+}
+
+// Handler serves the metrics in the prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveDecision records an auth decision and the time it took
+func ObserveDecision(decision string, reason string, issuer string, route string, duration time.Duration) {
+	Decisions.WithLabelValues(decision, reason, issuer, route).Inc()
+	HandlerDuration.WithLabelValues(decision).Observe(duration.Seconds())
+}
+
+// ObserveShadowDenial records a denial of a stage in shadow mode, which did not deny the request
+func ObserveShadowDenial(stage string, reason string, issuer string, route string) {
+	ShadowDenials.WithLabelValues(stage, reason, issuer, route).Inc()
+}
+
+// ObserveDecode records the time taken to decode a token
+func ObserveDecode(issuer string, duration time.Duration) {
+	DecodeDuration.WithLabelValues(issuer).Observe(duration.Seconds())
+}
+
+// ObserveJwksFetch records the result of a keyset fetch
+func ObserveJwksFetch(issuer string, keys int, err error) {
+	if err != nil {
+		JwksFetches.WithLabelValues(issuer, "failure").Inc()
+		return
+	}
+	JwksFetches.WithLabelValues(issuer, "success").Inc()
+	JwksKeys.WithLabelValues(issuer).Set(float64(keys))
+	lastRefresh.set(issuer, time.Now())
+}
+
+// ObserveVerificationCache records a lookup in the result cache
+func ObserveVerificationCache(hit bool) {
+	if hit {
+		VerificationCache.WithLabelValues("hit").Inc()
+		return
+	}
+	VerificationCache.WithLabelValues("miss").Inc()
+}
+
+// refreshCollector reports the time elapsed since each issuer's last successful keyset fetch, computed when scraped
+type refreshCollector struct {
+	desc *prometheus.Desc
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func (c *refreshCollector) set(issuer string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last[issuer] = t
+}
+
+// Describe implements prometheus.Collector
+func (c *refreshCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector
+func (c *refreshCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for issuer, t := range c.last {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, time.Since(t).Seconds(), issuer)
+	}
+}
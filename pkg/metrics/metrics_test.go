@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveJwksFetch(t *testing.T) {
+	issuer := "http://localhost/jwks.json"
+	ObserveJwksFetch(issuer, 2, nil)
+	ObserveJwksFetch(issuer, 0, errors.New("connection refused"))
+
+	if got := testutil.ToFloat64(JwksFetches.WithLabelValues(issuer, "success")); got != 1 {
+		t.Errorf("expected 1 successful fetch, got %v", got)
+	}
+	if got := testutil.ToFloat64(JwksFetches.WithLabelValues(issuer, "failure")); got != 1 {
+		t.Errorf("expected 1 failed fetch, got %v", got)
+	}
+	if got := testutil.ToFloat64(JwksKeys.WithLabelValues(issuer)); got != 2 {
+		t.Errorf("expected the failed fetch to keep the key count at 2, got %v", got)
+	}
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `ambassador_auth_jwt_jwks_seconds_since_last_refresh{issuer="http://localhost/jwks.json"}`) {
+		t.Errorf("expected time since last refresh in metrics, got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,42 @@
+package replay
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisStore is a Store shared by every replica, keeping the ids in redis until they expire
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// NewRedisStore returns a RedisStore connected to the redis url, e.g. redis://:password@localhost:6379/0.
+// Keys are the ids prefixed with prefix.
+func NewRedisStore(url string, prefix string) (*RedisStore, error) {
+	options, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &RedisStore{client: redis.NewClient(options), prefix: prefix}, nil
+}
+
+// Seen implements Store. The id is set only if it does not exist yet, so that concurrent uses of a token are detected.
+func (s *RedisStore) Seen(ctx context.Context, id string, expiry time.Time) (bool, error) {
+	ttl := time.Until(expiry)
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	set, err := s.client.SetNX(ctx, s.prefix+id, 1, ttl).Result()
+	if err != nil {
+		return false, err
+	}
+	return !set, nil
+}
+
+// Close closes the connections to redis
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
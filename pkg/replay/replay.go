@@ -0,0 +1,90 @@
+// Package replay records the ids (jti claim) of the tokens seen, so that one-time tokens can not be used twice
+package replay
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrFull is returned by MemoryStore when it holds as many unexpired ids as it can. Ids are never evicted before they
+// expire, since the tokens they belong to could then be used again.
+var ErrFull = errors.New("replay store is full")
+
+// Store records token ids until the tokens expire
+type Store interface {
+	// Seen records the id until expiry and reports whether it was already recorded
+	Seen(ctx context.Context, id string, expiry time.Time) (bool, error)
+}
+
+// MemoryStore is a Store keeping at most a fixed number of ids in memory, until they expire. New ids are rejected with
+// ErrFull while it is full. It is safe for concurrent use.
+type MemoryStore struct {
+	size int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+type memoryEntry struct {
+	id     string
+	expiry time.Time
+}
+
+// NewMemoryStore returns a MemoryStore holding up to size ids
+func NewMemoryStore(size int) *MemoryStore {
+	return &MemoryStore{
+		size:    size,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+		now:     time.Now,
+	}
+}
+
+// Seen implements Store
+func (s *MemoryStore) Seen(ctx context.Context, id string, expiry time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if element, ok := s.entries[id]; ok {
+		if element.Value.(*memoryEntry).expiry.After(now) {
+			return true, nil
+		}
+		s.remove(element)
+	}
+	// Drop expired entries from the back, then from the whole store when it is still full
+	for back := s.order.Back(); back != nil && !back.Value.(*memoryEntry).expiry.After(now); back = s.order.Back() {
+		s.remove(back)
+	}
+	if s.order.Len() >= s.size {
+		for element := s.order.Front(); element != nil; {
+			next := element.Next()
+			if !element.Value.(*memoryEntry).expiry.After(now) {
+				s.remove(element)
+			}
+			element = next
+		}
+	}
+	if s.order.Len() >= s.size {
+		return false, ErrFull
+	}
+	s.entries[id] = s.order.PushFront(&memoryEntry{id: id, expiry: expiry})
+	return false, nil
+}
+
+// remove drops the entry of the element
+func (s *MemoryStore) remove(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.entries, element.Value.(*memoryEntry).id)
+}
+
+// Len returns the number of ids recorded
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
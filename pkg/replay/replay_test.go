@@ -0,0 +1,80 @@
+package replay
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore(2)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	if seen, _ := store.Seen(ctx, "a", now.Add(2*time.Minute)); seen {
+		t.Error("expected a to be new")
+	}
+	if seen, _ := store.Seen(ctx, "a", now.Add(2*time.Minute)); !seen {
+		t.Error("expected a to be a replay")
+	}
+	store.Seen(ctx, "b", now.Add(time.Minute))
+	if _, err := store.Seen(ctx, "c", now.Add(time.Minute)); err != ErrFull {
+		t.Errorf("expected the full store to reject new ids, got %v", err)
+	}
+	if seen, _ := store.Seen(ctx, "b", now.Add(time.Minute)); !seen {
+		t.Error("expected b to be kept until it expires")
+	}
+
+	// b is recorded after a but expires first, it is dropped from the middle of the store
+	now = now.Add(90 * time.Second)
+	if seen, err := store.Seen(ctx, "c", now.Add(time.Minute)); seen || err != nil {
+		t.Errorf("expected c to be recorded once b expired, got %v, %v", seen, err)
+	}
+	if seen, _ := store.Seen(ctx, "a", now.Add(time.Minute)); !seen {
+		t.Error("expected a to be a replay")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if seen, _ := store.Seen(ctx, "c", now.Add(time.Minute)); seen {
+		t.Error("expected c to be forgotten once expired")
+	}
+	if store.Len() != 1 {
+		t.Errorf("expected expired ids to be dropped, got %d", store.Len())
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	store, err := NewRedisStore("redis://"+server.Addr(), "jti:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+
+	if seen, err := store.Seen(ctx, "a", time.Now().Add(time.Minute)); seen || err != nil {
+		t.Errorf("expected a to be new, got %v, %v", seen, err)
+	}
+	if seen, err := store.Seen(ctx, "a", time.Now().Add(time.Minute)); !seen || err != nil {
+		t.Errorf("expected a to be a replay, got %v, %v", seen, err)
+	}
+	if ttl := server.TTL("jti:a"); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("expected the id to expire with the token, got ttl %s", ttl)
+	}
+	server.FastForward(2 * time.Minute)
+	if seen, _ := store.Seen(ctx, "a", time.Now().Add(time.Minute)); seen {
+		t.Error("expected a to be forgotten once expired")
+	}
+
+	server.Close()
+	if _, err := store.Seen(ctx, "b", time.Now().Add(time.Minute)); err == nil {
+		t.Error("expected an error when redis is down")
+	}
+}
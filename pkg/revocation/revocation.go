@@ -0,0 +1,240 @@
+// Package revocation keeps a denylist of tokens, revoked by jti, subject or signing key id
+package revocation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/token"
+)
+
+// Entry types, telling which part of the token Entry.Value is matched against
+const (
+	TypeJTI     = "jti"
+	TypeSubject = "sub"
+	TypeKeyID   = "kid"
+)
+
+// DefaultTTL is how long entries without an expiration are kept
+var DefaultTTL = 30 * 24 * time.Hour
+
+// Entry revokes the tokens matching its type and value
+type Entry struct {
+	// Type is jti, sub or kid
+	Type string `json:"type"`
+	// Value is the revoked jti, subject or key id
+	Value string `json:"value"`
+	// Issuer limits the entry to the tokens of an issuer url. It applies to every issuer when empty.
+	Issuer string `json:"issuer,omitempty"`
+	// IssuedBefore limits a sub entry to the tokens issued (iat) before it. Tokens without iat are revoked.
+	IssuedBefore *time.Time `json:"issued_before,omitempty"`
+	// ExpiresAt is when the entry is removed, DefaultTTL after it is added when empty
+	ExpiresAt time.Time `json:"expires_at"`
+	// Reason is a note on why the tokens were revoked
+	Reason string `json:"reason,omitempty"`
+
+	fromFile bool
+}
+
+// key identifies the entry, adding an entry with the same key replaces it
+func (e Entry) key() string {
+	return e.Issuer + "|" + e.Type + "|" + e.Value
+}
+
+// validate checks the entry type and value
+func (e Entry) validate() error {
+	switch e.Type {
+	case TypeJTI, TypeKeyID:
+		if e.IssuedBefore != nil {
+			return fmt.Errorf("issued_before only applies to %s entries", TypeSubject)
+		}
+	case TypeSubject:
+	default:
+		return fmt.Errorf("unknown revocation type %q", e.Type)
+	}
+	if e.Value == "" {
+		return fmt.Errorf("revocation of type %s has no value", e.Type)
+	}
+	return nil
+}
+
+// matches reports whether the entry revokes the token
+func (e Entry) matches(issuer string, kid string, claims token.Claims) bool {
+	if e.Issuer != "" && e.Issuer != issuer {
+		return false
+	}
+	switch e.Type {
+	case TypeJTI:
+		return claims.ID() == e.Value
+	case TypeKeyID:
+		return kid == e.Value
+	case TypeSubject:
+		if claims.Subject() != e.Value {
+			return false
+		}
+		if e.IssuedBefore == nil {
+			return true
+		}
+		iat, ok := claims.IssuedAt()
+		return !ok || iat.Before(*e.IssuedBefore)
+	}
+	return false
+}
+
+// List is a denylist of tokens. It is safe for concurrent use.
+type List struct {
+	mu sync.RWMutex
+	// entries are keyed by issuer, type and value, see Entry.key
+	entries  map[string]Entry
+	fileTime time.Time
+	now      func() time.Time
+}
+
+// NewList returns an empty List
+func NewList() *List {
+	return &List{entries: map[string]Entry{}, now: time.Now}
+}
+
+// Add validates the entry and adds it to the list, replacing the entry with the same type, value and issuer
+func (l *List) Add(e Entry) (Entry, error) {
+	if err := e.validate(); err != nil {
+		return e, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e.ExpiresAt.IsZero() {
+		e.ExpiresAt = l.now().Add(DefaultTTL)
+	}
+	l.entries[e.key()] = e
+	return e, nil
+}
+
+// Remove deletes an entry, reporting whether it existed
+func (l *List) Remove(entryType string, value string, issuer string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := Entry{Type: entryType, Value: value, Issuer: issuer}.key()
+	if _, ok := l.entries[key]; !ok {
+		return false
+	}
+	delete(l.entries, key)
+	return true
+}
+
+// Revoked returns the entry revoking the token signed by kid with the claims, if any. Expired entries are ignored.
+// Only the entries of the token's jti, subject and key id are looked up, for every issuer and for the token's issuer,
+// so that checking a token does not depend on the size of the list.
+func (l *List) Revoked(issuer string, kid string, claims token.Claims) (Entry, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	now := l.now()
+	for _, candidate := range []Entry{
+		{Type: TypeJTI, Value: claims.ID()},
+		{Type: TypeSubject, Value: claims.Subject()},
+		{Type: TypeKeyID, Value: kid},
+	} {
+		if candidate.Value == "" {
+			continue
+		}
+		for _, scope := range []string{"", issuer} {
+			candidate.Issuer = scope
+			if e, ok := l.entries[candidate.key()]; ok && e.ExpiresAt.After(now) && e.matches(issuer, kid, claims) {
+				return e, true
+			}
+		}
+	}
+	return Entry{}, false
+}
+
+// Entries returns the entries that have not expired, sorted by type and value. Expired entries are removed.
+func (l *List) Entries() []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	entries := make([]Entry, 0, len(l.entries))
+	for key, e := range l.entries {
+		if !e.ExpiresAt.After(now) {
+			delete(l.entries, key)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key() < entries[j].key()
+	})
+	return entries
+}
+
+// LoadFile replaces the entries previously loaded from a file with the json array of entries in path.
+// Entries added with Add are kept. Nothing changes when the file is invalid.
+func (l *List) LoadFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	loaded := []Entry{}
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return err
+	}
+	for _, e := range loaded {
+		if err := e.validate(); err != nil {
+			return err
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, e := range l.entries {
+		if e.fromFile {
+			delete(l.entries, key)
+		}
+	}
+	for _, e := range loaded {
+		if e.ExpiresAt.IsZero() {
+			e.ExpiresAt = info.ModTime().Add(DefaultTTL)
+		}
+		e.fromFile = true
+		l.entries[e.key()] = e
+	}
+	l.fileTime = info.ModTime()
+	return nil
+}
+
+// WatchFile loads path again whenever it changes, checking every interval until the context is done
+func (l *List) WatchFile(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(path)
+			if err != nil {
+				log.WithFields(log.Fields{"file": path, "err": err}).Error("Unable to read revocation file")
+				continue
+			}
+			l.mu.RLock()
+			changed := !info.ModTime().Equal(l.fileTime)
+			l.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := l.LoadFile(path); err != nil {
+				log.WithFields(log.Fields{"file": path, "err": err}).Error("Unable to load revocation file, keeping the previous entries")
+				continue
+			}
+			log.WithField("file", path).Info("Reloaded revocation file")
+		}
+	}
+}
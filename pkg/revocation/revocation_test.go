@@ -0,0 +1,107 @@
+package revocation
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRevoked(t *testing.T) {
+	list := NewList()
+	now := time.Now()
+	list.now = func() time.Time { return now }
+	cutoff := now.Add(-time.Hour)
+	for _, e := range []Entry{
+		{Type: TypeJTI, Value: "leaked"},
+		{Type: TypeSubject, Value: "alice"},
+		{Type: TypeSubject, Value: "bob", IssuedBefore: &cutoff},
+		{Type: TypeKeyID, Value: "compromised", Issuer: "https://idp/jwks"},
+		{Type: TypeSubject, Value: "bob", Issuer: "https://other/jwks"},
+	} {
+		if _, err := list.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name    string
+		issuer  string
+		kid     string
+		claims  map[string]interface{}
+		revoked bool
+	}{
+		{"jti", "https://idp/jwks", "k1", map[string]interface{}{"jti": "leaked"}, true},
+		{"other jti", "https://idp/jwks", "k1", map[string]interface{}{"jti": "fine"}, false},
+		{"sub", "https://idp/jwks", "k1", map[string]interface{}{"sub": "alice", "iat": float64(now.Unix())}, true},
+		{"sub issued before", "https://idp/jwks", "k1", map[string]interface{}{"sub": "bob", "iat": float64(cutoff.Add(-time.Minute).Unix())}, true},
+		{"sub issued after", "https://idp/jwks", "k1", map[string]interface{}{"sub": "bob", "iat": float64(now.Unix())}, false},
+		{"sub without iat", "https://idp/jwks", "k1", map[string]interface{}{"sub": "bob"}, true},
+		{"kid", "https://idp/jwks", "compromised", map[string]interface{}{}, true},
+		{"kid of another issuer", "https://other/jwks", "compromised", map[string]interface{}{}, false},
+		{"sub of the issuer after the global cutoff", "https://other/jwks", "k1", map[string]interface{}{"sub": "bob", "iat": float64(now.Unix())}, true},
+		{"jti matching another type", "https://idp/jwks", "k1", map[string]interface{}{"jti": "alice"}, false},
+	}
+	for _, test := range tests {
+		if _, revoked := list.Revoked(test.issuer, test.kid, test.claims); revoked != test.revoked {
+			t.Errorf("%s: expected revoked %v", test.name, test.revoked)
+		}
+	}
+
+	now = now.Add(DefaultTTL + time.Second)
+	if _, revoked := list.Revoked("https://idp/jwks", "k1", map[string]interface{}{"jti": "leaked"}); revoked {
+		t.Error("expected entries to expire")
+	}
+	if entries := list.Entries(); len(entries) != 0 {
+		t.Errorf("expected expired entries to be removed, got %+v", entries)
+	}
+
+	for _, invalid := range []Entry{{Type: "email", Value: "x"}, {Type: TypeJTI}, {Type: TypeKeyID, Value: "k", IssuedBefore: &cutoff}} {
+		if _, err := list.Add(invalid); err == nil {
+			t.Errorf("expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "revoked.json")
+	ioutil.WriteFile(path, []byte(`[{"type": "jti", "value": "a"}, {"type": "sub", "value": "alice"}]`), 0600)
+
+	list := NewList()
+	list.Add(Entry{Type: TypeKeyID, Value: "manual"})
+	if err := list.LoadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if entries := list.Entries(); len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %+v", entries)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go list.WatchFile(ctx, path, 10*time.Millisecond)
+	ioutil.WriteFile(path, []byte(`[{"type": "jti", "value": "b"}]`), 0600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path, future, future)
+	entries := list.Entries()
+	for i := 0; i < 100 && len(entries) != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		entries = list.Entries()
+	}
+	if len(entries) != 2 || entries[0].Value != "b" || entries[1].Value != "manual" {
+		t.Errorf("expected the file entries to be replaced and the manual one kept, got %+v", entries)
+	}
+
+	ioutil.WriteFile(path, []byte(`[{"type": "email", "value": "b"}]`), 0600)
+	if err := list.LoadFile(path); err == nil {
+		t.Error("expected an invalid file to be rejected")
+	}
+	if len(list.Entries()) != 2 {
+		t.Error("expected the entries to be kept when the file is invalid")
+	}
+}
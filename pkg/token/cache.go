@@ -0,0 +1,120 @@
+package token
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Keyset sources reported by KeyStore.Init
+const (
+	SourceIssuer = "issuer"
+	SourceCache  = "cache"
+)
+
+var (
+	// CacheDir is the directory the last good keyset of every issuer is saved to. The cache is disabled when it is empty.
+	CacheDir = ""
+	// CacheMaxAge is the maximum age of a cached keyset used at startup
+	CacheMaxAge = 7 * 24 * time.Hour
+)
+
+// cachedKeySet is the format of the cache files
+type cachedKeySet struct {
+	Issuer    string             `json:"issuer"`
+	FetchedAt time.Time          `json:"fetched_at"`
+	Keys      jose.JSONWebKeySet `json:"keys"`
+}
+
+// cacheFile returns the path of the issuer's cache file
+func cacheFile(issuer string) string {
+	sum := sha256.Sum256([]byte(issuer))
+	return filepath.Join(CacheDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// saveCache writes the keyset to the issuer's cache file, replacing it atomically
+func saveCache(issuer string, keyset KeySet) error {
+	if CacheDir == "" {
+		return nil
+	}
+	data, err := json.Marshal(cachedKeySet{Issuer: issuer, FetchedAt: keyset.FetchedAt, Keys: keyset.Keys})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(CacheDir, ".jwks-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cacheFile(issuer))
+}
+
+// loadCache reads the issuer's cached keyset, rejecting it when it is older than CacheMaxAge
+func loadCache(issuer string) (KeySet, error) {
+	if CacheDir == "" {
+		return KeySet{}, fmt.Errorf("no keyset cache directory")
+	}
+	data, err := ioutil.ReadFile(cacheFile(issuer))
+	if err != nil {
+		return KeySet{}, err
+	}
+	cached := cachedKeySet{}
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return KeySet{}, err
+	}
+	if cached.Issuer != issuer {
+		return KeySet{}, fmt.Errorf("cache file is for issuer %s", cached.Issuer)
+	}
+	if age := time.Since(cached.FetchedAt); age > CacheMaxAge {
+		return KeySet{}, fmt.Errorf("cached keyset is %s old, more than %s", age.Round(time.Second), CacheMaxAge)
+	}
+	if err := validateKeySet(cached.Keys); err != nil {
+		return KeySet{}, err
+	}
+	return KeySet{Keys: cached.Keys, FetchedAt: cached.FetchedAt, FromCache: true}, nil
+}
+
+// Init fetches the issuer's keyset, falling back to the cached one when the issuer can not be reached.
+// It returns where the keyset came from, SourceIssuer or SourceCache.
+func (s *KeyStore) Init(ctx context.Context, issuer string) (string, error) {
+	_, err := s.Refresh(ctx, issuer)
+	if err == nil {
+		log.WithFields(log.Fields{
+			"issuer": issuer,
+			"source": SourceIssuer,
+		}).Info("Loaded keyset")
+		return SourceIssuer, nil
+	}
+	keyset, cacheErr := loadCache(issuer)
+	if cacheErr != nil {
+		log.WithFields(log.Fields{
+			"issuer": issuer,
+			"err":    cacheErr,
+		}).Debug("No usable cached keyset")
+		return "", err
+	}
+	s.store(issuer, keyset)
+	log.WithFields(log.Fields{
+		"issuer":     issuer,
+		"source":     SourceCache,
+		"fetched_at": keyset.FetchedAt,
+		"err":        err,
+	}).Warn("Unable to fetch keyset, loaded it from the cache")
+	return SourceCache, nil
+}
@@ -0,0 +1,176 @@
+package token
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	jwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Claims is the claim set of a token as issued. Numbers are json.Number, so that large integers keep their precision.
+// The registered claims of RFC 7519 are available through typed accessors.
+type Claims map[string]interface{}
+
+// parseClaims decodes a token payload, keeping numbers as json.Number
+func parseClaims(payload []byte) (Claims, error) {
+	claims := Claims{}
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verifyClaims checks the token's signature with the key and returns its claims
+func verifyClaims(token *jwt.JSONWebToken, key interface{}) (Claims, error) {
+	payload := rawPayload{}
+	if err := token.Claims(key, &payload); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrSignatureInvalid, err)
+	}
+	claims, err := parseClaims(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformed, err)
+	}
+	return claims, nil
+}
+
+// rawPayload keeps the payload of a verified token as is
+type rawPayload []byte
+
+// UnmarshalJSON implements json.Unmarshaler
+func (p *rawPayload) UnmarshalJSON(data []byte) error {
+	*p = append((*p)[:0], data...)
+	return nil
+}
+
+// Copy returns a deep copy of the claims, so that they can be modified without changing the verified ones in Results
+func (c Claims) Copy() Claims {
+	if c == nil {
+		return nil
+	}
+	return copyClaim(map[string]interface{}(c)).(map[string]interface{})
+}
+
+// copyClaim copies the objects and arrays of a decoded claim
+func copyClaim(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for name, item := range v {
+			copied[name] = copyClaim(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = copyClaim(item)
+		}
+		return copied
+	default:
+		return value
+	}
+}
+
+// String returns a string claim, or an empty string when it is missing or not a string
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Number returns a numeric claim, whether it was decoded as json.Number or float64
+func (c Claims) Number(name string) (float64, bool) {
+	switch v := c[name].(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// Time returns a NumericDate claim, seconds since the epoch, as a time
+func (c Claims) Time(name string) (time.Time, bool) {
+	if n, ok := c[name].(json.Number); ok {
+		if seconds, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+			return time.Unix(seconds, 0), true
+		}
+	}
+	f, ok := c.Number(name)
+	if !ok || math.IsNaN(f) || math.IsInf(f, 0) {
+		return time.Time{}, false
+	}
+	seconds, fraction := math.Modf(f)
+	return time.Unix(int64(seconds), int64(fraction*1e9)), true
+}
+
+// Issuer returns the iss claim
+func (c Claims) Issuer() string {
+	return c.String("iss")
+}
+
+// Subject returns the sub claim
+func (c Claims) Subject() string {
+	return c.String("sub")
+}
+
+// ID returns the jti claim
+func (c Claims) ID() string {
+	return c.String("jti")
+}
+
+// Audience returns the aud claim, which can be a single string or a list of strings
+func (c Claims) Audience() []string {
+	switch v := c["aud"].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		audience := make([]string, 0, len(v))
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+		return audience
+	case []string:
+		return v
+	}
+	return nil
+}
+
+// Expiry returns the exp claim
+func (c Claims) Expiry() (time.Time, bool) {
+	return c.Time("exp")
+}
+
+// expiration returns the exp claim, or the non standard expires_at claim in RFC3339 format when there is no exp
+func (c Claims) expiration() (time.Time, bool) {
+	if exp, ok := c.Expiry(); ok {
+		return exp, true
+	}
+	if expiresAt := c.String("expires_at"); expiresAt != "" {
+		if exp, err := time.Parse(time.RFC3339, expiresAt); err == nil {
+			return exp, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// NotBefore returns the nbf claim
+func (c Claims) NotBefore() (time.Time, bool) {
+	return c.Time("nbf")
+}
+
+// IssuedAt returns the iat claim
+func (c Claims) IssuedAt() (time.Time, bool) {
+	return c.Time("iat")
+}
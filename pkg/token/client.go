@@ -0,0 +1,111 @@
+package token
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	// Clients maps an issuer url to the settings of the HTTP client its keyset is fetched with
+	Clients = map[string]ClientConfig{}
+	// DefaultTimeout bounds the keyset fetches of issuers without their own timeout
+	DefaultTimeout = 10 * time.Second
+)
+
+// ClientConfig configures the HTTP client used to fetch an issuer's keyset
+type ClientConfig struct {
+	// Timeout of a fetch, e.g. "5s". DefaultTimeout is used when empty.
+	Timeout string `json:"timeout,omitempty"`
+	// CAFile is a PEM bundle of CAs trusted on top of the system ones
+	CAFile string `json:"ca_file,omitempty"`
+	// CertFile and KeyFile are the PEM client certificate and key presented to the issuer
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// ProxyURL is the proxy requests go through. The HTTPS_PROXY, HTTP_PROXY and NO_PROXY env variables are used when empty.
+	ProxyURL string `json:"proxy_url,omitempty"`
+	// Headers are added to every request
+	Headers map[string]string `json:"headers,omitempty"`
+
+	client *http.Client
+}
+
+// UnmarshalJSON parses the settings and builds the client, so that invalid settings are reported at startup
+func (config *ClientConfig) UnmarshalJSON(data []byte) error {
+	type plain ClientConfig
+	if err := json.Unmarshal(data, (*plain)(config)); err != nil {
+		return err
+	}
+	return config.compile()
+}
+
+// compile builds the HTTP client from the settings. Clients without a timeout get DefaultTimeout in clientFor, so that
+// it can be set after the settings are parsed.
+func (config *ClientConfig) compile() error {
+	var timeout time.Duration
+	if config.Timeout != "" {
+		d, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %s", err)
+		}
+		timeout = d
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig := &tls.Config{}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	if config.ProxyURL != "" {
+		proxy, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("invalid proxy_url: %s", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	config.client = &http.Client{Transport: transport, Timeout: timeout}
+	return nil
+}
+
+// clientFor returns the HTTP client and extra headers to fetch the issuer's keyset with
+func clientFor(issuer string) (*http.Client, map[string]string, error) {
+	config, ok := Clients[issuer]
+	if !ok {
+		return &http.Client{Timeout: DefaultTimeout}, nil, nil
+	}
+	if config.client == nil {
+		if err := config.compile(); err != nil {
+			return nil, nil, err
+		}
+	}
+	client := config.client
+	if config.Timeout == "" {
+		withTimeout := *client
+		withTimeout.Timeout = DefaultTimeout
+		client = &withTimeout
+	}
+	return client, config.Headers, nil
+}
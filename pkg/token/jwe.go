@@ -0,0 +1,122 @@
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2"
+	jwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+// ErrDecryptionFailed is returned when an encrypted token can not be decrypted with any of the DecryptionKeys
+var ErrDecryptionFailed = errors.New("Could not decrypt jwt")
+
+// DecryptionKeys are the private keys, *rsa.PrivateKey or *ecdsa.PrivateKey, nested (signed then encrypted) tokens are decrypted with
+var DecryptionKeys []interface{}
+
+// headerCompression is the JWE header holding the compression algorithm of the payload
+const headerCompression jose.HeaderKey = "zip"
+
+// keyAlgorithms are the key management algorithms accepted for encrypted tokens. RSA1_5 is not accepted, see RFC 8725 section 3.2.
+var keyAlgorithms = map[jose.KeyAlgorithm]bool{
+	jose.RSA_OAEP:       true,
+	jose.RSA_OAEP_256:   true,
+	jose.ECDH_ES:        true,
+	jose.ECDH_ES_A128KW: true,
+	jose.ECDH_ES_A192KW: true,
+	jose.ECDH_ES_A256KW: true,
+}
+
+// LoadDecryptionKeys reads PEM encoded RSA or EC private keys (PKCS #1, PKCS #8 or SEC 1) from the files
+func LoadDecryptionKeys(paths []string) ([]interface{}, error) {
+	keys := []interface{}{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM data found in %s", path)
+		}
+		key, err := parsePrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func parsePrivateKey(der []byte) (interface{}, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, errors.New("not an RSA or EC private key")
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", key)
+}
+
+// isEncrypted tells a JWE compact token, with five parts, from a JWS compact token
+func isEncrypted(raw string) bool {
+	return strings.Count(raw, ".") == 4
+}
+
+// parse reads a signed token, decrypting it first with one of the decryption keys when it is a nested (signed then
+// encrypted) token
+func parse(raw string, decryptionKeys []interface{}) (*jwt.JSONWebToken, error) {
+	if !isEncrypted(raw) {
+		token, err := jwt.ParseSigned(raw)
+		if err != nil {
+			return nil, ErrMalformed
+		}
+		return token, nil
+	}
+	nested, err := jwt.ParseSignedAndEncrypted(raw)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	alg := jose.KeyAlgorithm(nested.Headers[0].Algorithm)
+	if !keyAlgorithms[alg] {
+		return nil, fmt.Errorf("%w: key algorithm %s is not accepted", ErrDecryptionFailed, alg)
+	}
+	// go-jose inflates compressed payloads without a size limit, a small token could exhaust the memory (CVE-2024-28180)
+	if zip, ok := nested.Headers[0].ExtraHeaders[headerCompression]; ok {
+		return nil, fmt.Errorf("%w: compression %v is not accepted", ErrDecryptionFailed, zip)
+	}
+	for _, key := range decryptionKeys {
+		if !keyFits(alg, key) {
+			continue
+		}
+		if token, err := nested.Decrypt(key); err == nil {
+			return token, nil
+		}
+	}
+	return nil, ErrDecryptionFailed
+}
+
+// keyFits reports whether the key can be used with the key management algorithm
+func keyFits(alg jose.KeyAlgorithm, key interface{}) bool {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return alg == jose.RSA_OAEP || alg == jose.RSA_OAEP_256
+	case *ecdsa.PrivateKey:
+		return strings.HasPrefix(string(alg), string(jose.ECDH_ES))
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package token
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// MinRefreshInterval is the minimum delay between two fetches of an issuer's keyset triggered by a token with an unknown
+// key id, so that tokens with random key ids can not flood the issuer
+var MinRefreshInterval = 30 * time.Second
+
+// errRefreshThrottled is returned when a keyset was fetched less than MinRefreshInterval ago
+var errRefreshThrottled = errors.New("keyset was fetched recently")
+
+// KeySet is an issuer's JWK Set and the time it was fetched
+type KeySet struct {
+	Keys      jose.JSONWebKeySet
+	FetchedAt time.Time
+	// FromCache is set when the keyset was loaded from CacheDir at startup, and not fetched from the issuer since
+	FromCache bool
+
+	// generation changes every time a different keyset is stored, so that results verified with a previous keyset can be told apart
+	generation uint64
+}
+
+// KeyStore keeps the JWK Set of every issuer. It is safe for concurrent use.
+type KeyStore struct {
+	mu      sync.RWMutex
+	keysets map[string]KeySet
+	// fetches holds the time of the last fetch of every issuer's keyset, successful or not
+	fetches map[string]time.Time
+}
+
+// generation is shared by every KeyStore, so that keysets of different stores never have the same generation
+var generation uint64
+
+// NewKeyStore returns an empty KeyStore
+func NewKeyStore() *KeyStore {
+	return &KeyStore{keysets: map[string]KeySet{}, fetches: map[string]time.Time{}}
+}
+
+// Get returns the issuer's keyset, if it was ever fetched
+func (s *KeyStore) Get(issuer string) (KeySet, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keyset, ok := s.keysets[issuer]
+	return keyset, ok
+}
+
+// Set replaces the issuer's keyset
+func (s *KeyStore) Set(issuer string, keys jose.JSONWebKeySet) {
+	s.store(issuer, KeySet{Keys: keys, FetchedAt: time.Now()})
+}
+
+// store saves the issuer's keyset, with a new generation unless it holds the same keys as the previous one
+func (s *KeyStore) store(issuer string, keyset KeySet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if previous, ok := s.keysets[issuer]; ok && sameKeys(previous.Keys, keyset.Keys) {
+		keyset.generation = previous.generation
+	} else {
+		keyset.generation = atomic.AddUint64(&generation, 1)
+	}
+	s.keysets[issuer] = keyset
+}
+
+// sameKeys reports whether the keysets hold the same keys
+func sameKeys(a jose.JSONWebKeySet, b jose.JSONWebKeySet) bool {
+	aJSON, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bJSON, err := json.Marshal(b)
+	return err == nil && string(aJSON) == string(bJSON)
+}
+
+// Refresh fetches the issuer's keyset, stores it and saves it to the cache. The previous keyset is kept when the fetch fails.
+func (s *KeyStore) Refresh(ctx context.Context, issuer string) (KeySet, error) {
+	s.mu.Lock()
+	s.fetches[issuer] = time.Now()
+	s.mu.Unlock()
+	return s.refresh(ctx, issuer)
+}
+
+// refreshUnknownKid fetches the issuer's keyset for a token whose key id is not in it, unless it was fetched less than
+// MinRefreshInterval ago. It returns the current keyset and errRefreshThrottled then.
+func (s *KeyStore) refreshUnknownKid(ctx context.Context, issuer string) (KeySet, error) {
+	s.mu.Lock()
+	if time.Since(s.fetches[issuer]) < MinRefreshInterval {
+		keyset := s.keysets[issuer]
+		s.mu.Unlock()
+		log.WithField("issuer", issuer).Debug("Unknown key id, the keyset was fetched less than MinRefreshInterval ago")
+		return keyset, errRefreshThrottled
+	}
+	s.fetches[issuer] = time.Now()
+	s.mu.Unlock()
+	keyset, err := s.refresh(ctx, issuer)
+	if err != nil {
+		raven.CaptureError(err, nil)
+		log.WithFields(log.Fields{
+			"issuer": issuer,
+			"err":    err,
+		}).Error("Unable to update keyset")
+	} else {
+		log.WithFields(log.Fields{
+			"keyset": keyset.Keys,
+			"issuer": issuer,
+		}).Info("Updating Keyset")
+	}
+	return keyset, err
+}
+
+func (s *KeyStore) refresh(ctx context.Context, issuer string) (KeySet, error) {
+	keys, err := JwkSetGet(ctx, issuer)
+	if err != nil {
+		keyset, _ := s.Get(issuer)
+		return keyset, err
+	}
+	s.Set(issuer, keys)
+	keyset, _ := s.Get(issuer)
+	if err := saveCache(issuer, keyset); err != nil {
+		log.WithFields(log.Fields{
+			"issuer": issuer,
+			"err":    err,
+		}).Warn("Unable to save keyset to the cache")
+	}
+	return keyset, nil
+}
+
+// Issuers returns the issuers with a keyset, sorted
+func (s *KeyStore) Issuers() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	issuers := make([]string, 0, len(s.keysets))
+	for issuer := range s.keysets {
+		issuers = append(issuers, issuer)
+	}
+	sort.Strings(issuers)
+	return issuers
+}
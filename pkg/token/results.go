@@ -0,0 +1,127 @@
+package token
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// Results caches verified tokens, so that tokens used again are not parsed and verified again.
+// It is disabled when its size is zero.
+var Results = NewResultCache(10000, 5*time.Minute)
+
+// ResultCache is a bounded LRU cache of verified tokens, keyed by a hash of the issuer and the token.
+// Entries are kept until the token expires or for the cache's TTL, whichever comes first, and are ignored once
+// the issuer's keyset changes. It is safe for concurrent use.
+type ResultCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[[sha256.Size]byte]*list.Element
+	now     func() time.Time
+}
+
+type result struct {
+	key        [sha256.Size]byte
+	verified   Verified
+	generation uint64
+	expiry     time.Time
+}
+
+// NewResultCache returns a ResultCache holding up to size results for at most ttl
+func NewResultCache(size int, ttl time.Duration) *ResultCache {
+	return &ResultCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[[sha256.Size]byte]*list.Element{},
+		now:     time.Now,
+	}
+}
+
+func resultKey(issuer string, raw string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(issuer + "\x00" + raw))
+}
+
+// get returns the token verified with the keyset generation. Callers must not modify its claims.
+func (c *ResultCache) get(issuer string, raw string, generation uint64) (Verified, bool) {
+	if c == nil || c.size <= 0 {
+		return Verified{}, false
+	}
+	key := resultKey(issuer, raw)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return Verified{}, false
+	}
+	entry := element.Value.(*result)
+	if entry.generation != generation || !entry.expiry.After(c.now()) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return Verified{}, false
+	}
+	c.order.MoveToFront(element)
+	return entry.verified, true
+}
+
+// add caches the token verified with the keyset generation until exp, or the cache's TTL when it is sooner
+func (c *ResultCache) add(issuer string, raw string, generation uint64, verified Verified, exp time.Time) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+	expiry := c.now().Add(c.ttl)
+	if !exp.IsZero() && exp.Before(expiry) {
+		expiry = exp
+	}
+	if !expiry.After(c.now()) {
+		return
+	}
+	key := resultKey(issuer, raw)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+	}
+	c.entries[key] = c.order.PushFront(&result{key: key, verified: verified, generation: generation, expiry: expiry})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*result).key)
+	}
+}
+
+// Forget removes the token's result, e.g. when it is revoked
+func (c *ResultCache) Forget(issuer string, raw string) {
+	if c == nil {
+		return
+	}
+	key := resultKey(issuer, raw)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.order.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+// Purge removes every result
+func (c *ResultCache) Purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order.Init()
+	c.entries = map[[sha256.Size]byte]*list.Element{}
+}
+
+// Len returns the number of results cached
+func (c *ResultCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
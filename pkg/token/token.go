@@ -1,30 +1,63 @@
 package token
 
 import (
+	"context"
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"strings"
+	"time"
 
 	raven "github.com/getsentry/raven-go"
 	log "github.com/sirupsen/logrus"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/metrics"
+	"github.com/tomwganem/ambassador-auth-jwt/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/square/go-jose.v2"
-	jwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+var (
+	// ErrMalformed is returned when the token can not be parsed as a signed jwt
+	ErrMalformed = errors.New("Could not read jwt")
+	// ErrUnknownKid is returned when the token's key id is not in the issuer's jwk set, even after refreshing it
+	ErrUnknownKid = errors.New("Can not find token's key id in jwk set")
+	// ErrSignatureInvalid is returned when the token's signature can not be verified with the issuer's key
+	ErrSignatureInvalid = errors.New("Token signature is invalid")
+	// ErrIssuerUnavailable is returned when the issuer's jwk set was never fetched
+	ErrIssuerUnavailable = errors.New("Issuer jwk set is not available")
+	// ErrInvalidKeySet is returned when a fetched jwk set is rejected. The previous keyset of the issuer is kept.
+	ErrInvalidKeySet = errors.New("Invalid jwk set")
+)
+
+var (
+	// MaxKeySetSize is the maximum size in bytes of a jwk set response
+	MaxKeySetSize int64 = 1 << 20
+	// MinRSAKeySize is the minimum size in bits of the RSA keys of a jwk set
+	MinRSAKeySize = 2048
 )
 
 // JwkSetGet will call the url provided JWT_ISSUER and retreive a JWK Set.
-func JwkSetGet(issuer string) (jose.JSONWebKeySet, error) {
-	keyset := jose.JSONWebKeySet{}
-	resp, err := http.Get(issuer)
+func JwkSetGet(ctx context.Context, issuer string) (jose.JSONWebKeySet, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "jwks fetch", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("jwt.issuer", issuer)))
+	defer span.End()
+	keyset, err := jwkSetFetch(ctx, issuer)
+	metrics.ObserveJwksFetch(issuer, len(keyset.Keys), err)
 	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Unable to retrieve keyset")
 		return keyset, err
 	}
-	defer resp.Body.Close()
-	if err := json.NewDecoder(resp.Body).Decode(&keyset); err != nil && err != io.EOF {
-		return keyset, err
-	}
+	span.SetAttributes(attribute.Int("jwks.keys", len(keyset.Keys)))
 	log.WithFields(log.Fields{
 		"keyset": keyset,
 		"issuer": issuer,
@@ -32,77 +65,141 @@ func JwkSetGet(issuer string) (jose.JSONWebKeySet, error) {
 	return keyset, nil
 }
 
-// Initialize issuer with its jwk set
+func jwkSetFetch(ctx context.Context, issuer string) (jose.JSONWebKeySet, error) {
+	client, headers, err := clientFor(issuer)
+	if err != nil {
+		return jose.JSONWebKeySet{}, err
+	}
+	return fetchKeySet(ctx, client, headers, issuer)
+}
+
+// fetchKeySet gets the jwk set at url with the client and checks it
+func fetchKeySet(ctx context.Context, client *http.Client, headers map[string]string, url string) (jose.JSONWebKeySet, error) {
+	keyset := jose.JSONWebKeySet{}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return keyset, err
+	}
+	req.Header.Set("Accept", "application/jwk-set+json, application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := client.Do(req)
+	if err != nil {
+		return keyset, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return keyset, fmt.Errorf("%w: unexpected status %s", ErrInvalidKeySet, resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return keyset, fmt.Errorf("%w: unexpected content type %q", ErrInvalidKeySet, resp.Header.Get("Content-Type"))
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxKeySetSize+1))
+	if err != nil {
+		return keyset, err
+	}
+	if int64(len(body)) > MaxKeySetSize {
+		return keyset, fmt.Errorf("%w: larger than %d bytes", ErrInvalidKeySet, MaxKeySetSize)
+	}
+	if err := json.Unmarshal(body, &keyset); err != nil {
+		return jose.JSONWebKeySet{}, fmt.Errorf("%w: %s", ErrInvalidKeySet, err)
+	}
+	if err := validateKeySet(keyset); err != nil {
+		return jose.JSONWebKeySet{}, err
+	}
+	return keyset, nil
+}
+
+// validateKeySet rejects empty keysets, keysets holding private or symmetric keys and RSA keys smaller than MinRSAKeySize
+func validateKeySet(keyset jose.JSONWebKeySet) error {
+	if len(keyset.Keys) == 0 {
+		return fmt.Errorf("%w: no keys", ErrInvalidKeySet)
+	}
+	for _, key := range keyset.Keys {
+		if !key.IsPublic() {
+			return fmt.Errorf("%w: key %q is not a public key", ErrInvalidKeySet, key.KeyID)
+		}
+		if rsaKey, ok := key.Key.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < MinRSAKeySize {
+			return fmt.Errorf("%w: RSA key %q is %d bits, %d required", ErrInvalidKeySet, key.KeyID, rsaKey.N.BitLen(), MinRSAKeySize)
+		}
+	}
+	return nil
+}
+
+// JwkSetGetMap initializes every issuer with its jwk set
 func JwkSetGetMap(issuers []string) (map[string]jose.JSONWebKeySet, error) {
 	keysetIssuerMap := make(map[string]jose.JSONWebKeySet)
 	for _, issuer := range issuers {
-		keyset := jose.JSONWebKeySet{}
-		resp, err := http.Get(issuer)
+		keyset, err := JwkSetGet(context.Background(), issuer)
 		if err != nil {
 			return keysetIssuerMap, err
 		}
-		defer resp.Body.Close()
-		if err := json.NewDecoder(resp.Body).Decode(&keyset); err != nil && err != io.EOF {
-			return keysetIssuerMap, err
-		}
-		log.WithFields(log.Fields{
-			"keyset": keyset,
-			"issuer": issuer,
-		}).Info("Retreiving Keyset")
 		keysetIssuerMap[issuer] = keyset
 	}
 	return keysetIssuerMap, nil
 }
 
+// Verified is a token whose signature was verified
+type Verified struct {
+	Claims Claims
+	// KeyID and Algorithm are the key id and signature algorithm in the header of the token, or of the inner token of a
+	// nested token
+	KeyID     string
+	Algorithm string
+}
 
-// Decode the raw token and validate it with a JWK Set.
-func Decode(jwtoken string, jwkset jose.JSONWebKeySet, issuer string) (map[string]interface{}, jose.JSONWebKeySet, error) {
-	claims := struct {
-		*jwt.Claims
-		ExpiresAt      string `json:"expires_at,omitempty"`
-		Scope          string `json:"scope,omitempty"`
-		OrganizationID string `json:"organization_id,omitempty"`
-		UUID           string `json:"uuid,omitempty"`
-	}{}
-	mapClaims := make(map[string]interface{})
-	token, err := jwt.ParseSigned(jwtoken)
-	if err != nil {
-		return mapClaims, jwkset, fmt.Errorf("Could not read jwt")
-	}
-	keyid := token.Headers[0].KeyID
-	jwk := jwkset.Key(keyid)
-	if len(jwk) == 0 {
-		jwkset, err = JwkSetGet(issuer)
-		if err != nil {
-			raven.CaptureErrorAndWait(err, nil)
-			log.WithFields(log.Fields{
-				"issuer": issuer,
-				"err":    err,
-			}).Fatal("Unable to update keyset")
-		}
-		log.WithFields(log.Fields{
-			"keyset": jwkset,
-			"issuer": issuer,
-		}).Info("Updating Keyset")
-		jwk = jwkset.Key(keyid)
-		if len(jwk) == 0 {
-			return mapClaims, jwkset, errors.New("Can not find token's key id in jwk set")
+// Decode the raw token and validate it with the issuer's JWK Set, see DecodeVerified. Verified claims are cached in Results,
+// callers must not modify them.
+func Decode(ctx context.Context, jwtoken string, keys *KeyStore, issuer string) (Claims, error) {
+	verified, err := DecodeVerified(ctx, jwtoken, keys, issuer)
+	return verified.Claims, err
+}
+
+// DecodeVerified decodes the raw token and validates it with the issuer's JWK Set, with a Verifier accepting the
+// asymmetric algorithms and leaving the expiration to the caller. Nested tokens are decrypted with DecryptionKeys first.
+// The keyset is refreshed when it does not contain the token's key id, at most once every MinRefreshInterval.
+// Verified tokens are cached in Results, callers must not modify their claims.
+func DecodeVerified(ctx context.Context, jwtoken string, keys *KeyStore, issuer string) (Verified, error) {
+	defer func(start time.Time) {
+		metrics.ObserveDecode(issuer, time.Since(start))
+	}(time.Now())
+	ctx, span := tracing.Tracer().Start(ctx, "token.Decode", trace.WithAttributes(attribute.String("jwt.issuer", issuer)))
+	defer span.End()
+	if keyset, ok := keys.Get(issuer); ok && Results.size > 0 {
+		cached, hit := Results.get(issuer, jwtoken, keyset.generation)
+		metrics.ObserveVerificationCache(hit)
+		span.SetAttributes(attribute.Bool("cache.hit", hit))
+		if hit {
+			return cached, nil
 		}
 	}
-
-	if err := token.Claims(jwk[0].Key.(*rsa.PublicKey), &claims); err != nil {
-		raven.CaptureError(err, nil)
-		return mapClaims, jwkset, err
+	span.SetAttributes(attribute.Bool("jwt.encrypted", isEncrypted(jwtoken)))
+	source := &decodeKeys{storeKeys: storeKeys{store: keys, issuer: issuer}}
+	verifier := &Verifier{
+		keys:           source,
+		algorithms:     signatureAlgorithms,
+		decryptionKeys: DecryptionKeys,
+		now:            time.Now,
+		tracer:         tracing.Tracer(),
+		skipExpiry:     true,
 	}
-	marshalClaims, err := json.Marshal(claims)
-	if err != nil {
-		raven.CaptureError(err, nil)
-		return mapClaims, jwkset, err
+	verified, err := verifier.verify(ctx, jwtoken)
+	verificationErr := &VerificationError{}
+	if errors.As(err, &verificationErr) {
+		span.SetAttributes(attribute.String("jwt.kid", verificationErr.KeyID), attribute.String("jwt.alg", verificationErr.Algorithm))
+	} else {
+		span.SetAttributes(attribute.String("jwt.kid", verified.KeyID), attribute.String("jwt.alg", verified.Algorithm))
 	}
-	if err := json.Unmarshal(marshalClaims, &mapClaims); err != nil {
-		raven.CaptureError(err, nil)
-		return mapClaims, jwkset, err
+	if err != nil {
+		if errors.Is(err, ErrSignatureInvalid) {
+			raven.CaptureError(err, nil)
+		}
+		span.SetStatus(codes.Error, err.Error())
+		return Verified{}, err
 	}
-
-	return mapClaims, jwkset, nil
+	exp, _ := verified.Claims.expiration()
+	Results.add(issuer, jwtoken, source.generation, verified, exp)
+	return verified, nil
 }
@@ -1,7 +1,35 @@
 package token
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/square/go-jose.v2"
+	jwt "gopkg.in/square/go-jose.v2/jwt"
 )
 
 func TestDecode(t *testing.T) {
@@ -52,3 +80,637 @@ func TestDecode(t *testing.T) {
 
 func TestJwkSetGet(t *testing.T) {
 }
+
+func TestKeyStoreRefresh(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keyset := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keyset)
+	}))
+
+	store := NewKeyStore()
+	fetched, err := store.Refresh(context.Background(), server.URL)
+	if err != nil || len(fetched.Keys.Key("test")) != 1 {
+		t.Fatalf("expected keyset with kid test, got %+v, %v", fetched, err)
+	}
+	server.Close()
+	kept, err := store.Refresh(context.Background(), server.URL)
+	if err == nil {
+		t.Fatal("expected refresh to fail")
+	}
+	if !kept.FetchedAt.Equal(fetched.FetchedAt) || len(kept.Keys.Keys) != 1 {
+		t.Errorf("expected previous keyset to be kept, got %+v", kept)
+	}
+}
+
+func TestKeyStoreRefreshUnknownKid(t *testing.T) {
+	defer func(interval time.Duration) { MinRefreshInterval = interval }(MinRefreshInterval)
+	MinRefreshInterval = time.Hour
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}})
+	}))
+	defer server.Close()
+	signer, _ := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", "random"))
+	raw, _ := jwt.Signed(signer).Claims(map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()}).CompactSerialize()
+
+	store := NewKeyStore()
+	if _, err := store.Init(context.Background(), server.URL); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := store.Get(server.URL)
+	for i := 0; i < 10; i++ {
+		if _, err := Decode(context.Background(), raw, store, server.URL); !errors.Is(err, ErrUnknownKid) {
+			t.Fatalf("expected ErrUnknownKid, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Errorf("expected unknown key ids not to fetch the keyset within MinRefreshInterval, got %d fetches", n)
+	}
+
+	MinRefreshInterval = 0
+	Decode(context.Background(), raw, store, server.URL)
+	after, _ := store.Get(server.URL)
+	if n := atomic.LoadInt32(&fetches); n != 2 || after.generation != before.generation {
+		t.Errorf("expected the unchanged keyset to keep its generation, got %d fetches and generation %d, was %d", n, after.generation, before.generation)
+	}
+}
+
+// writeSelfSigned writes a self-signed client certificate and its key to dir
+func writeSelfSigned(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	return cert, certFile, keyFile
+}
+
+func TestClientConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { Clients = map[string]ClientConfig{} }()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keyset := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}}
+	headers := make(chan http.Header, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keyset)
+	})
+
+	// A private CA and a required client certificate
+	clientCert, certFile, keyFile := writeSelfSigned(t, dir)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	caFile := filepath.Join(dir, "ca.crt")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+
+	if _, err := JwkSetGet(context.Background(), server.URL); err == nil {
+		t.Error("expected fetch to fail without the CA and client certificate")
+	}
+	config := `{"timeout": "2s", "ca_file": "` + caFile + `", "cert_file": "` + certFile + `", "key_file": "` + keyFile + `", "headers": {"X-Api-Key": "secret"}}`
+	if err := json.Unmarshal([]byte(`{"`+server.URL+`": `+config+`}`), &Clients); err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := JwkSetGet(context.Background(), server.URL)
+	if err != nil || len(fetched.Key("test")) != 1 {
+		t.Fatalf("expected keyset with kid test, got %+v, %v", fetched, err)
+	}
+	if got := (<-headers).Get("X-Api-Key"); got != "secret" {
+		t.Errorf("expected X-Api-Key header to be sent, got %q", got)
+	}
+
+	// Requests go through the issuer's proxy
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+	issuer := "http://idp.invalid/jwks"
+	Clients[issuer] = ClientConfig{ProxyURL: proxy.URL}
+	if _, err := JwkSetGet(context.Background(), issuer); err != nil {
+		t.Errorf("expected fetch through the proxy to succeed, got %v", err)
+	}
+	<-headers
+	defer func(timeout time.Duration) { DefaultTimeout = timeout }(DefaultTimeout)
+	DefaultTimeout = time.Minute
+	if client, _, _ := clientFor(issuer); client.Timeout != time.Minute {
+		t.Errorf("expected clients without a timeout to use DefaultTimeout set after parsing, got %s", client.Timeout)
+	}
+
+	for _, invalid := range []string{`{"timeout": "soon"}`, `{"ca_file": "/nonexistent"}`, `{"cert_file": "` + certFile + `"}`} {
+		var c ClientConfig
+		if err := json.Unmarshal([]byte(invalid), &c); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestJwkSetValidation(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	smallKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	valid := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}}
+	encode := func(keyset jose.JSONWebKeySet) string {
+		b, _ := json.Marshal(keyset)
+		return string(b)
+	}
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		valid       bool
+	}{
+		{"valid", 200, "application/json", encode(valid), true},
+		{"jwk set content type", 200, "application/jwk-set+json; charset=utf-8", encode(valid), true},
+		{"server error", 500, "application/json", encode(valid), false},
+		{"html", 200, "text/html", encode(valid), false},
+		{"empty body", 200, "application/json", "", false},
+		{"empty keyset", 200, "application/json", `{"keys": []}`, false},
+		{"too large", 200, "application/json", `{"keys": [], "padding": "` + strings.Repeat("a", 2048) + `"}`, false},
+		{"private key", 200, "application/json", encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: key, KeyID: "test", Algorithm: "RS256"}}}), false},
+		{"symmetric key", 200, "application/json", encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: []byte("secret"), KeyID: "test", Algorithm: "HS256"}}}), false},
+		{"small RSA key", 200, "application/json", encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &smallKey.PublicKey, KeyID: "test", Algorithm: "RS256"}}}), false},
+	}
+	defer func(size int64) { MaxKeySetSize = size }(MaxKeySetSize)
+	MaxKeySetSize = 2048
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", test.contentType)
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+		store := NewKeyStore()
+		store.Set(server.URL, valid)
+		keyset, err := store.Refresh(context.Background(), server.URL)
+		server.Close()
+		if test.valid && err != nil {
+			t.Errorf("%s: expected keyset to be accepted, got %v", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidKeySet) {
+			t.Errorf("%s: expected ErrInvalidKeySet, got %v", test.name, err)
+		}
+		if len(keyset.Keys.Key("test")) != 1 {
+			t.Errorf("%s: expected a keyset with kid test to be kept, got %+v", test.name, keyset)
+		}
+	}
+}
+
+func TestKeyStoreCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwks-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dir string, maxAge time.Duration) { CacheDir, CacheMaxAge = dir, maxAge }(CacheDir, CacheMaxAge)
+	CacheDir = dir
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keyset := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keyset)
+	}))
+
+	source, err := NewKeyStore().Init(context.Background(), server.URL)
+	if err != nil || source != SourceIssuer {
+		t.Fatalf("expected keyset from the issuer, got %s, %v", source, err)
+	}
+	server.Close()
+
+	store := NewKeyStore()
+	source, err = store.Init(context.Background(), server.URL)
+	if err != nil || source != SourceCache {
+		t.Fatalf("expected keyset from the cache, got %s, %v", source, err)
+	}
+	cached, _ := store.Get(server.URL)
+	if len(cached.Keys.Key("test")) != 1 || time.Since(cached.FetchedAt) > time.Minute {
+		t.Errorf("expected cached keyset with kid test and its fetch time, got %+v", cached)
+	}
+
+	CacheMaxAge = time.Nanosecond
+	if _, err := NewKeyStore().Init(context.Background(), server.URL); err == nil {
+		t.Error("expected a cached keyset older than CacheMaxAge to be rejected")
+	}
+	CacheMaxAge = time.Hour
+	CacheDir = ""
+	if _, err := NewKeyStore().Init(context.Background(), server.URL); err == nil {
+		t.Error("expected init to fail without a cache")
+	}
+}
+
+// encryptToken signs the claims with signingKey, then encrypts the token for encryptionKey
+func encryptToken(t *testing.T, signingKey *rsa.PrivateKey, alg jose.KeyAlgorithm, encryptionKey interface{}, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: signingKey}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: alg, Key: encryptionKey}, (&jose.EncrypterOptions{}).WithContentType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jwt.SignedAndEncrypted(signer, encrypter).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestDecodeEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { DecryptionKeys = nil }()
+	signingKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaFile, ecFile := filepath.Join(dir, "rsa.pem"), filepath.Join(dir, "ec.pem")
+	ioutil.WriteFile(rsaFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), 0600)
+	ecDER, _ := x509.MarshalPKCS8PrivateKey(ecKey)
+	ioutil.WriteFile(ecFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecDER}), 0600)
+	DecryptionKeys, err = LoadDecryptionKeys([]string{rsaFile, ecFile})
+	if err != nil || len(DecryptionKeys) != 2 {
+		t.Fatalf("expected 2 decryption keys, got %d, %v", len(DecryptionKeys), err)
+	}
+
+	keys := NewKeyStore()
+	keys.Set("issuer", jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &signingKey.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}})
+	claims := map[string]interface{}{"sub": "partner", "exp": time.Now().Add(time.Hour).Unix()}
+	for _, test := range []struct {
+		alg jose.KeyAlgorithm
+		key interface{}
+	}{
+		{jose.RSA_OAEP, &rsaKey.PublicKey},
+		{jose.RSA_OAEP_256, &rsaKey.PublicKey},
+		{jose.ECDH_ES, &ecKey.PublicKey},
+		{jose.ECDH_ES_A256KW, &ecKey.PublicKey},
+	} {
+		raw := encryptToken(t, signingKey, test.alg, test.key, claims)
+		decoded, err := DecodeVerified(context.Background(), raw, keys, "issuer")
+		if err != nil || decoded.Claims["sub"] != "partner" {
+			t.Errorf("%s: expected the inner token's claims, got %v, %v", test.alg, decoded.Claims, err)
+		}
+		if decoded.KeyID != "test" || decoded.Algorithm != "RS256" {
+			t.Errorf("%s: expected the inner token's key id and algorithm, got %q and %q", test.alg, decoded.KeyID, decoded.Algorithm)
+		}
+	}
+
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if _, err := Decode(context.Background(), encryptToken(t, signingKey, jose.RSA_OAEP, &otherKey.PublicKey, claims), keys, "issuer"); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("expected ErrDecryptionFailed for a token encrypted for another key, got %v", err)
+	}
+	if _, err := Decode(context.Background(), encryptToken(t, signingKey, jose.RSA1_5, &rsaKey.PublicKey, claims), keys, "issuer"); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("expected RSA1_5 to be rejected, got %v", err)
+	}
+	if _, err := Decode(context.Background(), encryptToken(t, otherKey, jose.RSA_OAEP, &rsaKey.PublicKey, claims), keys, "issuer"); !errors.Is(err, ErrSignatureInvalid) {
+		t.Errorf("expected the inner token's signature to be verified, got %v", err)
+	}
+
+	signer, _ := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: signingKey}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	encrypter, _ := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: jose.RSA_OAEP, Key: &rsaKey.PublicKey},
+		(&jose.EncrypterOptions{Compression: jose.DEFLATE}).WithContentType("JWT"))
+	compressed, err := jwt.SignedAndEncrypted(signer, encrypter).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decode(context.Background(), compressed, keys, "issuer"); !errors.Is(err, ErrDecryptionFailed) || !strings.Contains(err.Error(), "compression") {
+		t.Errorf("expected a compressed token to be rejected, got %v", err)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	defer func(results *ResultCache) { Results = results }(Results)
+	Results = NewResultCache(2, time.Hour)
+	now := time.Now()
+	Results.now = func() time.Time { return now }
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keys := NewKeyStore()
+	keys.Set("issuer", jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}})
+	signer, _ := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", "test"))
+	sign := func(sub string, exp time.Time) string {
+		raw, _ := jwt.Signed(signer).Claims(map[string]interface{}{"sub": sub, "exp": exp.Unix()}).CompactSerialize()
+		return raw
+	}
+	decode := func(raw string) map[string]interface{} {
+		claims, err := Decode(context.Background(), raw, keys, "issuer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return claims
+	}
+	same := func(a, b map[string]interface{}) bool {
+		return fmt.Sprintf("%p", a) == fmt.Sprintf("%p", b)
+	}
+
+	raw := sign("alice", now.Add(time.Minute))
+	first := decode(raw)
+	if !same(first, decode(raw)) {
+		t.Error("expected the second decode to be served from the cache")
+	}
+	if verified, _ := DecodeVerified(context.Background(), raw, keys, "issuer"); verified.KeyID != "test" {
+		t.Errorf("expected the cached result to keep the key id, got %q", verified.KeyID)
+	}
+	if _, err := Decode(context.Background(), raw, keys, "other"); err == nil {
+		t.Error("expected results to be cached per issuer")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if same(first, decode(raw)) {
+		t.Error("expected the result to expire with the token")
+	}
+
+	raw = sign("bob", now.Add(time.Hour))
+	cached := decode(raw)
+	keys.Set("issuer", jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}})
+	if !same(cached, decode(raw)) {
+		t.Error("expected the result to be kept when the same keyset is fetched again")
+	}
+	rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keys.Set("issuer", jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+		{Key: &rotated.PublicKey, KeyID: "rotated", Algorithm: "RS256", Use: "sig"},
+	}})
+	if same(cached, decode(raw)) {
+		t.Error("expected the result to be ignored once the keyset changes")
+	}
+	cached = decode(raw)
+	Results.Forget("issuer", raw)
+	if same(cached, decode(raw)) {
+		t.Error("expected a forgotten result to be verified again")
+	}
+
+	decode(sign("carol", now.Add(time.Hour)))
+	decode(sign("dave", now.Add(time.Hour)))
+	if Results.Len() != 2 {
+		t.Errorf("expected the cache to hold 2 results, got %d", Results.Len())
+	}
+}
+
+func TestDecodeClaims(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keys := NewKeyStore()
+	keys.Set("issuer", jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}})
+	signer, _ := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", "test"))
+	exp := time.Now().Add(time.Hour).Unix()
+	payload := fmt.Sprintf(`{"iss":"issuer","sub":"alice","jti":"1","aud":["api","admin"],"exp":%d,"iat":1500000000,`+
+		`"roles":["reader","writer"],"https://example.com/tenant":{"id":12345678901234567890,"name":"acme"}}`, exp)
+	signed, err := signer.Sign([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := signed.CompactSerialize()
+
+	claims, err := Decode(context.Background(), raw, keys, "issuer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Issuer() != "issuer" || claims.Subject() != "alice" || claims.ID() != "1" {
+		t.Errorf("unexpected registered claims %v", claims)
+	}
+	if aud := claims.Audience(); len(aud) != 2 || aud[0] != "api" || aud[1] != "admin" {
+		t.Errorf("expected the audience list, got %v", aud)
+	}
+	if expiry, ok := claims.Expiry(); !ok || expiry.Unix() != exp {
+		t.Errorf("expected exp %d, got %v", exp, expiry)
+	}
+	if iat, ok := claims.IssuedAt(); !ok || iat.Unix() != 1500000000 {
+		t.Errorf("expected iat 1500000000, got %v", iat)
+	}
+	if _, ok := claims.NotBefore(); ok {
+		t.Error("expected no nbf")
+	}
+	if roles, _ := claims["roles"].([]interface{}); len(roles) != 2 || roles[1] != "writer" {
+		t.Errorf("expected the custom roles claim, got %v", claims["roles"])
+	}
+	tenant, _ := claims["https://example.com/tenant"].(map[string]interface{})
+	if tenant["id"] != json.Number("12345678901234567890") || tenant["name"] != "acme" {
+		t.Errorf("expected the namespaced claim with its large id preserved, got %v", tenant)
+	}
+	encoded, _ := json.Marshal(claims)
+	if !strings.Contains(string(encoded), `"id":12345678901234567890`) {
+		t.Errorf("expected the large id to be encoded verbatim, got %s", encoded)
+	}
+}
+
+func TestDecodeECKey(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keys := NewKeyStore()
+	keys.Set("issuer", jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "ec", Algorithm: "ES256", Use: "sig"}}})
+	signer, _ := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", "ec"))
+	raw, _ := jwt.Signed(signer).Claims(map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()}).CompactSerialize()
+	if claims, err := Decode(context.Background(), raw, keys, "issuer"); err != nil || claims.Subject() != "alice" {
+		t.Errorf("expected the EC signed token to be verified, got %v, %v", claims, err)
+	}
+}
+
+func TestDecodeMatchesVerifier(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keys := NewKeyStore()
+	keys.Set("issuer", jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}})
+	verifier, err := NewVerifier(WithKeys(keys.Source("issuer")), WithRequiredExpiry(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(signingKey interface{}, alg jose.SignatureAlgorithm, kid string, claims map[string]interface{}) string {
+		signer, _ := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: signingKey}, (&jose.SignerOptions{}).WithHeader("kid", kid))
+		raw, _ := jwt.Signed(signer).Claims(claims).CompactSerialize()
+		return raw
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+	for _, test := range []struct {
+		name string
+		raw  string
+		err  error
+	}{
+		{"valid", sign(key, jose.RS256, "test", map[string]interface{}{"sub": "alice", "exp": exp}), nil},
+		{"bad signature", sign(other, jose.RS256, "test", map[string]interface{}{"sub": "alice", "exp": exp}), ErrSignatureInvalid},
+		{"unknown key id", sign(key, jose.RS256, "other", map[string]interface{}{"sub": "alice", "exp": exp}), ErrUnknownKid},
+		{"symmetric algorithm", sign([]byte("0123456789abcdef0123456789abcdef"), jose.HS256, "test", map[string]interface{}{"sub": "alice", "exp": exp}), ErrAlgorithm},
+		{"algorithm not matching the key", sign(key, jose.RS384, "test", map[string]interface{}{"sub": "alice", "exp": exp}), ErrAlgorithm},
+		{"not valid yet", sign(key, jose.RS256, "test", map[string]interface{}{"sub": "alice", "exp": exp, "nbf": exp}), ErrNotValidYet},
+		{"malformed", "not a token", ErrMalformed},
+	} {
+		decoded, decodeErr := Decode(context.Background(), test.raw, keys, "issuer")
+		verified, verifyErr := verifier.Verify(context.Background(), test.raw)
+		if !errors.Is(decodeErr, test.err) || !errors.Is(verifyErr, test.err) {
+			t.Errorf("%s: expected %v from both, got %v from Decode and %v from Verify", test.name, test.err, decodeErr, verifyErr)
+		}
+		if test.err == nil && (decoded.Subject() != "alice" || verified.Subject() != "alice") {
+			t.Errorf("%s: expected the same claims, got %v from Decode and %v from Verify", test.name, decoded, verified)
+		}
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keyset := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}}
+	sign := func(alg jose.SignatureAlgorithm, kid string, claims map[string]interface{}) string {
+		signer, _ := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", kid))
+		raw, _ := jwt.Signed(signer).Claims(claims).CompactSerialize()
+		return raw
+	}
+	now := time.Unix(1600000000, 0)
+	verifier, err := NewVerifier(
+		WithKeys(StaticKeys(keyset)),
+		WithIssuer("https://issuer"),
+		WithAudience("api"),
+		WithLeeway(time.Minute),
+		WithClock(func() time.Time { return now }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{"iss": "https://issuer", "aud": []string{"web", "api"}, "sub": "alice", "exp": now.Unix() + 60}
+	}
+	claims, err := verifier.Verify(context.Background(), sign(jose.RS256, "test", valid()))
+	if err != nil || claims.Subject() != "alice" {
+		t.Fatalf("expected the token to be verified, got %v, %v", claims, err)
+	}
+
+	for _, test := range []struct {
+		name   string
+		change func(map[string]interface{})
+		alg    jose.SignatureAlgorithm
+		kid    string
+		err    error
+	}{
+		{"expired within leeway", func(c map[string]interface{}) { c["exp"] = now.Unix() - 30 }, jose.RS256, "test", nil},
+		{"expired", func(c map[string]interface{}) { c["exp"] = now.Unix() - 90 }, jose.RS256, "test", ErrExpired},
+		{"no expiration", func(c map[string]interface{}) { delete(c, "exp") }, jose.RS256, "test", ErrNoExpiry},
+		{"not valid yet", func(c map[string]interface{}) { c["nbf"] = now.Unix() + 90 }, jose.RS256, "test", ErrNotValidYet},
+		{"other issuer", func(c map[string]interface{}) { c["iss"] = "https://other" }, jose.RS256, "test", ErrInvalidIssuer},
+		{"other audience", func(c map[string]interface{}) { c["aud"] = "web" }, jose.RS256, "test", ErrInvalidAudience},
+		{"algorithm not matching the key", func(map[string]interface{}) {}, jose.RS384, "test", ErrAlgorithm},
+		{"algorithm not accepted", func(map[string]interface{}) {}, jose.PS256, "test", ErrAlgorithm},
+		{"unknown key id", func(map[string]interface{}) {}, jose.RS256, "other", ErrUnknownKid},
+	} {
+		claims := valid()
+		test.change(claims)
+		_, err := verifier.Verify(context.Background(), sign(test.alg, test.kid, claims))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+		verificationErr := &VerificationError{}
+		if test.err != nil && !errors.As(err, &verificationErr) {
+			t.Errorf("%s: expected a *VerificationError, got %T", test.name, err)
+		}
+	}
+	_, err = verifier.Verify(context.Background(), sign(jose.RS256, "test", map[string]interface{}{"iss": "https://issuer", "aud": "api", "sub": "bob", "exp": now.Unix() - 90}))
+	if verificationErr := (&VerificationError{}); !errors.As(err, &verificationErr) || verificationErr.Claims.Subject() != "bob" {
+		t.Errorf("expected the claims of the expired token in the error, got %v", err)
+	}
+	if _, err := verifier.Verify(context.Background(), "not a token"); !errors.Is(err, ErrMalformed) {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+
+	if _, err := NewVerifier(); err == nil {
+		t.Error("expected a verifier without keys to be rejected")
+	}
+	if _, err := NewVerifier(WithKeys(StaticKeys(keyset)), WithAlgorithms("HS256")); err == nil {
+		t.Error("expected HS256 to be rejected")
+	}
+}
+
+func TestVerifierTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keyset := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}}
+	signer, _ := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", "test"))
+	raw, _ := jwt.Signed(signer).Claims(map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()}).CompactSerialize()
+
+	verify := func(options ...Option) {
+		verifier, err := NewVerifier(append(options, WithKeys(StaticKeys(keyset)))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, caller := provider.Tracer("caller").Start(context.Background(), "handler")
+		if _, err := verifier.Verify(ctx, raw); err != nil {
+			t.Fatal(err)
+		}
+		caller.End()
+	}
+
+	verify()
+	if ended := recorder.Ended(); len(ended) != 1 || len(ended[0].Attributes()) != 0 {
+		t.Errorf("expected no span and the caller's span untouched without a tracer, got %d spans", len(ended))
+	}
+	verify(WithTracer(provider.Tracer("verifier")))
+	ended := recorder.Ended()
+	if len(ended) != 3 || ended[1].Name() != "verify signature" || ended[1].Parent().SpanID() != ended[2].SpanContext().SpanID() || len(ended[2].Attributes()) != 0 {
+		t.Errorf("expected a verify signature span under the caller's span with a tracer, got %d spans", len(ended))
+	}
+}
+
+func TestVerifierRemoteKeys(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	current, fetches := oldKey, 0
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		kid := "old"
+		if current == newKey {
+			kid = "new"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &current.PublicKey, KeyID: kid, Algorithm: "RS256", Use: "sig"}}})
+	}))
+	defer jwks.Close()
+	sign := func(key *rsa.PrivateKey, kid string) string {
+		signer, _ := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", kid))
+		raw, _ := jwt.Signed(signer).Claims(map[string]interface{}{"exp": time.Now().Add(time.Hour).Unix()}).CompactSerialize()
+		return raw
+	}
+	verifier, err := NewVerifier(WithKeys(RemoteKeys(jwks.URL, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := verifier.Verify(context.Background(), sign(oldKey, "old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("expected the keyset to be fetched once, got %d fetches", fetches)
+	}
+	current = newKey
+	if _, err := verifier.Verify(context.Background(), sign(newKey, "new")); !errors.Is(err, ErrUnknownKid) || fetches != 1 {
+		t.Errorf("expected the keyset not to be fetched again within MinRefreshInterval, got %v after %d fetches", err, fetches)
+	}
+	defer func(interval time.Duration) { MinRefreshInterval = interval }(MinRefreshInterval)
+	MinRefreshInterval = 0
+	if _, err := verifier.Verify(context.Background(), sign(newKey, "new")); err != nil || fetches != 2 {
+		t.Errorf("expected the keyset to be fetched again for a new key id, got %v after %d fetches", err, fetches)
+	}
+
+	unreachable, _ := NewVerifier(WithKeys(RemoteKeys("http://127.0.0.1:1/jwks", nil)))
+	if _, err := unreachable.Verify(context.Background(), sign(oldKey, "old")); !errors.Is(err, ErrIssuerUnavailable) {
+		t.Errorf("expected ErrIssuerUnavailable, got %v", err)
+	}
+}
@@ -0,0 +1,412 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/square/go-jose.v2"
+	jwt "gopkg.in/square/go-jose.v2/jwt"
+)
+
+var (
+	// ErrAlgorithm is returned when the token is signed with an algorithm the Verifier does not accept
+	ErrAlgorithm = errors.New("Token algorithm is not accepted")
+	// ErrNoExpiry is returned when the token has no expiration and the Verifier requires one
+	ErrNoExpiry = errors.New("Token has no expiration")
+	// ErrExpired is returned when the token expired
+	ErrExpired = errors.New("Token is expired")
+	// ErrNotValidYet is returned when the token's nbf claim is in the future
+	ErrNotValidYet = errors.New("Token is not valid yet")
+	// ErrInvalidIssuer is returned when the token's iss claim is not one of the expected issuers
+	ErrInvalidIssuer = errors.New("Token issuer is not accepted")
+	// ErrInvalidAudience is returned when none of the token's audiences is expected
+	ErrInvalidAudience = errors.New("Token audience is not accepted")
+)
+
+// VerificationError is the error returned by Verifier.Verify. Err is one of the package errors, e.g. ErrExpired or
+// ErrSignatureInvalid, possibly wrapped with details, so that it can be checked with errors.Is.
+type VerificationError struct {
+	Err error
+	// Claims are the claims of a token rejected after its signature was verified, e.g. an expired token
+	Claims Claims
+	// KeyID and Algorithm are the key id and signature algorithm in the token's header, empty when it could not be parsed
+	KeyID     string
+	Algorithm string
+}
+
+func (e *VerificationError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the cause of the error
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
+// signatureAlgorithms are the algorithms a Verifier can accept. Symmetric algorithms and none are not, since keys come
+// from public jwk sets.
+var signatureAlgorithms = map[string]bool{
+	string(jose.RS256): true, string(jose.RS384): true, string(jose.RS512): true,
+	string(jose.PS256): true, string(jose.PS384): true, string(jose.PS512): true,
+	string(jose.ES256): true, string(jose.ES384): true, string(jose.ES512): true,
+	string(jose.EdDSA): true,
+}
+
+// KeySource provides the keys a Verifier checks signatures with
+type KeySource interface {
+	// Keys returns the keys with the key id. It returns ErrUnknownKid when there are none.
+	Keys(ctx context.Context, kid string) ([]jose.JSONWebKey, error)
+}
+
+type staticKeys struct {
+	keyset jose.JSONWebKeySet
+}
+
+// StaticKeys returns a KeySource serving the keys of a jwk set that never changes
+func StaticKeys(keyset jose.JSONWebKeySet) KeySource {
+	return &staticKeys{keyset: keyset}
+}
+
+func (s *staticKeys) Keys(ctx context.Context, kid string) ([]jose.JSONWebKey, error) {
+	keys := s.keyset.Key(kid)
+	if len(keys) == 0 {
+		return nil, ErrUnknownKid
+	}
+	return keys, nil
+}
+
+type remoteKeys struct {
+	url    string
+	client *http.Client
+
+	mu     sync.Mutex
+	keyset *jose.JSONWebKeySet
+	// err is the error of the last fetch
+	err error
+	// fetchedAt is the time of the last fetch, successful or not
+	fetchedAt time.Time
+	// fetching is closed when the running fetch completes
+	fetching chan struct{}
+}
+
+// RemoteKeys returns a KeySource fetching the jwk set at url with the client, or with a client timing out after
+// DefaultTimeout when it is nil. The keyset is fetched when first used, and again when a key id is not in it, at most once
+// every MinRefreshInterval. Fetched keysets are checked like the gateway's, see MaxKeySetSize and MinRSAKeySize.
+func RemoteKeys(url string, client *http.Client) KeySource {
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+	return &remoteKeys{url: url, client: client}
+}
+
+func (r *remoteKeys) Keys(ctx context.Context, kid string) ([]jose.JSONWebKey, error) {
+	r.mu.Lock()
+	if r.keyset != nil {
+		if keys := r.keyset.Key(kid); len(keys) > 0 {
+			r.mu.Unlock()
+			return keys, nil
+		}
+	}
+	// Callers wait for the running fetch rather than starting their own, and the lock is not held while fetching
+	fetching := r.fetching
+	switch {
+	case fetching != nil:
+		r.mu.Unlock()
+		select {
+		case <-fetching:
+		case <-ctx.Done():
+		}
+		r.mu.Lock()
+	case r.fetchedAt.IsZero() || time.Since(r.fetchedAt) >= MinRefreshInterval:
+		fetching = make(chan struct{})
+		r.fetching, r.fetchedAt = fetching, time.Now()
+		r.mu.Unlock()
+		keyset, err := fetchKeySet(ctx, r.client, nil, r.url)
+		r.mu.Lock()
+		if err == nil {
+			r.keyset = &keyset
+		}
+		r.err = err
+		r.fetching = nil
+		close(fetching)
+	}
+	defer r.mu.Unlock()
+	if r.keyset == nil {
+		return nil, fmt.Errorf("%w: %v", ErrIssuerUnavailable, r.err)
+	}
+	if keys := r.keyset.Key(kid); len(keys) > 0 {
+		return keys, nil
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKid, r.err)
+	}
+	return nil, ErrUnknownKid
+}
+
+type storeKeys struct {
+	store  *KeyStore
+	issuer string
+}
+
+// Source returns a KeySource serving the issuer's keyset, refreshed when a key id is not in it at most once every
+// MinRefreshInterval
+func (s *KeyStore) Source(issuer string) KeySource {
+	return storeKeys{store: s, issuer: issuer}
+}
+
+func (s storeKeys) Keys(ctx context.Context, kid string) ([]jose.JSONWebKey, error) {
+	keys, _, err := s.keys(ctx, kid)
+	return keys, err
+}
+
+// keys returns the keys with the key id and the generation of the keyset they were found in
+func (s storeKeys) keys(ctx context.Context, kid string) ([]jose.JSONWebKey, uint64, error) {
+	keyset, ok := s.store.Get(s.issuer)
+	if !ok {
+		return nil, 0, ErrIssuerUnavailable
+	}
+	keys := keyset.Keys.Key(kid)
+	if len(keys) == 0 {
+		keyset, _ = s.store.refreshUnknownKid(ctx, s.issuer)
+		keys = keyset.Keys.Key(kid)
+	}
+	if len(keys) == 0 {
+		return nil, 0, ErrUnknownKid
+	}
+	return keys, keyset.generation, nil
+}
+
+// decodeKeys is the KeySource of a single Decode, recording the generation of the keyset the token was verified with
+type decodeKeys struct {
+	storeKeys
+	generation uint64
+}
+
+func (s *decodeKeys) Keys(ctx context.Context, kid string) ([]jose.JSONWebKey, error) {
+	keys, generation, err := s.keys(ctx, kid)
+	s.generation = generation
+	return keys, err
+}
+
+// Verifier verifies tokens the way the gateway does, Decode runs one: nested tokens are decrypted, the signature is
+// checked with the key named by the token's key id, then the expiration, not before, issuer and audience claims are
+// checked. Unlike Decode it does not log, report to Sentry, record metrics or cache results, so it can be embedded in
+// other services. It is safe for concurrent use.
+type Verifier struct {
+	keys           KeySource
+	issuers        []string
+	audiences      []string
+	algorithms     map[string]bool
+	leeway         time.Duration
+	requireExpiry  bool
+	decryptionKeys []interface{}
+	now            func() time.Time
+	tracer         trace.Tracer
+	// skipExpiry leaves the exp claim unchecked. Decode sets it, the gateway checks expiration in its own stage so that
+	// it can be disabled with CHECK_EXP.
+	skipExpiry bool
+}
+
+// Option configures a Verifier
+type Option func(*Verifier) error
+
+// WithKeys sets where the signing keys come from. It is required.
+func WithKeys(keys KeySource) Option {
+	return func(v *Verifier) error {
+		v.keys = keys
+		return nil
+	}
+}
+
+// WithIssuer accepts only the tokens whose iss claim is one of the issuers
+func WithIssuer(issuers ...string) Option {
+	return func(v *Verifier) error {
+		v.issuers = issuers
+		return nil
+	}
+}
+
+// WithAudience accepts only the tokens with one of the audiences in their aud claim
+func WithAudience(audiences ...string) Option {
+	return func(v *Verifier) error {
+		v.audiences = audiences
+		return nil
+	}
+}
+
+// WithAlgorithms sets the accepted signature algorithms. The asymmetric algorithms of RFC 7518, the ones the gateway
+// accepts, are by default.
+func WithAlgorithms(algorithms ...string) Option {
+	return func(v *Verifier) error {
+		v.algorithms = map[string]bool{}
+		for _, alg := range algorithms {
+			if !signatureAlgorithms[alg] {
+				return fmt.Errorf("unsupported signature algorithm %q", alg)
+			}
+			v.algorithms[alg] = true
+		}
+		return nil
+	}
+}
+
+// WithLeeway allows for clock skew when checking the exp and nbf claims
+func WithLeeway(leeway time.Duration) Option {
+	return func(v *Verifier) error {
+		if leeway < 0 {
+			return fmt.Errorf("negative leeway %s", leeway)
+		}
+		v.leeway = leeway
+		return nil
+	}
+}
+
+// WithRequiredExpiry sets whether tokens without an expiration are rejected, which they are by default
+func WithRequiredExpiry(required bool) Option {
+	return func(v *Verifier) error {
+		v.requireExpiry = required
+		return nil
+	}
+}
+
+// WithDecryptionKeys sets the private keys, *rsa.PrivateKey or *ecdsa.PrivateKey, nested tokens are decrypted with
+func WithDecryptionKeys(keys ...interface{}) Option {
+	return func(v *Verifier) error {
+		v.decryptionKeys = keys
+		return nil
+	}
+}
+
+// WithClock sets the function returning the current time, time.Now by default
+func WithClock(now func() time.Time) Option {
+	return func(v *Verifier) error {
+		v.now = now
+		return nil
+	}
+}
+
+// WithTracer records a "verify signature" span with the tracer for every signature checked, as a child of the span of
+// the context passed to Verify. No span is recorded by default.
+func WithTracer(tracer trace.Tracer) Option {
+	return func(v *Verifier) error {
+		v.tracer = tracer
+		return nil
+	}
+}
+
+// NewVerifier returns a Verifier configured with the options
+func NewVerifier(options ...Option) (*Verifier, error) {
+	v := &Verifier{
+		algorithms:    signatureAlgorithms,
+		requireExpiry: true,
+		now:           time.Now,
+	}
+	for _, option := range options {
+		if err := option(v); err != nil {
+			return nil, err
+		}
+	}
+	if v.keys == nil {
+		return nil, errors.New("no key source, see WithKeys")
+	}
+	if len(v.algorithms) == 0 {
+		return nil, errors.New("no signature algorithm accepted")
+	}
+	return v, nil
+}
+
+// Verify checks the raw token and returns its claims. Errors are *VerificationError.
+func (v *Verifier) Verify(ctx context.Context, raw string) (Claims, error) {
+	verified, err := v.verify(ctx, raw)
+	return verified.Claims, err
+}
+
+// verify checks the raw token and returns it with its claims. Errors are *VerificationError.
+func (v *Verifier) verify(ctx context.Context, raw string) (Verified, error) {
+	token, err := parse(raw, v.decryptionKeys)
+	if err != nil {
+		return Verified{}, &VerificationError{Err: err}
+	}
+	header := token.Headers[0]
+	fail := func(err error, claims Claims) (Verified, error) {
+		return Verified{}, &VerificationError{Err: err, Claims: claims, KeyID: header.KeyID, Algorithm: header.Algorithm}
+	}
+	if !v.algorithms[header.Algorithm] {
+		return fail(fmt.Errorf("%w: %s", ErrAlgorithm, header.Algorithm), nil)
+	}
+	keys, err := v.keys.Keys(ctx, header.KeyID)
+	if err != nil {
+		return fail(err, nil)
+	}
+	if keys[0].Algorithm != "" && keys[0].Algorithm != header.Algorithm {
+		return fail(fmt.Errorf("%w: key %q is for %s", ErrAlgorithm, header.KeyID, keys[0].Algorithm), nil)
+	}
+	claims, err := v.verifySignature(ctx, token, header, keys[0].Key)
+	if err != nil {
+		return fail(err, nil)
+	}
+	if err := v.check(claims); err != nil {
+		return fail(err, claims)
+	}
+	return Verified{Claims: claims, KeyID: header.KeyID, Algorithm: header.Algorithm}, nil
+}
+
+// verifySignature checks the token's signature with the key and returns its claims, in a span when a tracer is set
+func (v *Verifier) verifySignature(ctx context.Context, token *jwt.JSONWebToken, header jose.Header, key interface{}) (Claims, error) {
+	if v.tracer == nil {
+		return verifyClaims(token, key)
+	}
+	_, span := v.tracer.Start(ctx, "verify signature",
+		trace.WithAttributes(attribute.String("jwt.kid", header.KeyID), attribute.String("jwt.alg", header.Algorithm)))
+	defer span.End()
+	claims, err := verifyClaims(token, key)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "Token signature is invalid")
+	}
+	return claims, err
+}
+
+// check validates the registered claims of a verified token
+func (v *Verifier) check(claims Claims) error {
+	now := v.now()
+	if !v.skipExpiry {
+		exp, ok := claims.expiration()
+		if !ok && v.requireExpiry {
+			return ErrNoExpiry
+		}
+		if ok && exp.Add(v.leeway).Before(now) {
+			return fmt.Errorf("%w: at %s", ErrExpired, exp.UTC().Format(time.RFC3339))
+		}
+	}
+	if nbf, ok := claims.NotBefore(); ok && now.Add(v.leeway).Before(nbf) {
+		return fmt.Errorf("%w: before %s", ErrNotValidYet, nbf.UTC().Format(time.RFC3339))
+	}
+	if len(v.issuers) > 0 && !contains(v.issuers, claims.Issuer()) {
+		return fmt.Errorf("%w: %q", ErrInvalidIssuer, claims.Issuer())
+	}
+	if len(v.audiences) > 0 {
+		for _, audience := range claims.Audience() {
+			if contains(v.audiences, audience) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %q", ErrInvalidAudience, claims.Audience())
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package tracing
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/tomwganem/ambassador-auth-jwt"
+
+func init() {
+	// W3C traceparent and baggage headers are propagated even when spans are not exported,
+	// so traces started by the gateway continue through the JWKS requests we make
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// Enabled reports whether an OTLP endpoint is configured through OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+func Enabled() bool {
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Init sends spans to the OTLP/HTTP endpoint configured by the standard OTEL_EXPORTER_OTLP_* env variables.
+// The returned function flushes pending spans and stops the exporter.
+func Init(ctx context.Context, version string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(
+		resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceNameKey.String("ambassador-auth-jwt"),
+			semconv.ServiceVersionKey.String(version),
+		),
+		// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults above
+		resource.Environment(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.AlwaysSample())),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer used to instrument this module
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
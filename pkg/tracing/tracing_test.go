@@ -0,0 +1,66 @@
+package tracing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collectorStub is an in-process OTLP/HTTP collector that keeps the names of the spans it receives
+type collectorStub struct {
+	spans chan string
+}
+
+func (c *collectorStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	req := &coltracepb.ExportTraceServiceRequest{}
+	if r.URL.Path != "/v1/traces" || proto.Unmarshal(body, req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, rs := range req.ResourceSpans {
+		for _, ils := range rs.InstrumentationLibrarySpans {
+			for _, span := range ils.Spans {
+				c.spans <- span.Name
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write([]byte{})
+}
+
+func TestInit(t *testing.T) {
+	collector := &collectorStub{spans: make(chan string, 10)}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", server.URL)
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+
+	if !Enabled() {
+		t.Fatal("expected tracing to be enabled")
+	}
+	shutdown, err := Init(context.Background(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := Tracer().Start(context.Background(), "test span")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case name := <-collector.spans:
+		if name != "test span" {
+			t.Errorf("expected test span, got %s", name)
+		}
+	default:
+		t.Error("expected the collector to receive a span")
+	}
+}